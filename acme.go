@@ -0,0 +1,92 @@
+package main
+
+/*
+ * Certificates from Let's Encrypt (or another ACME CA), for the names in
+ * ACMEDomains, instead of TLSCert and TLSKey. They're requested on the first
+ * connection for each name and renewed before they expire. The CA checks we
+ * own the names by connecting to port 443 (TLS-ALPN-01), or to port 80 if
+ * HTTPRedirectListenport is set (HTTP-01), so one of those has to reach us.
+ *
+ * Account key and certificates are kept in MetadataDB if set, else in
+ * ACMECacheDir. With Chroot only the former works: the directory would be
+ * out of reach once we're in there.
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const acmeBucket = "acme"
+
+var acmeManager *autocert.Manager
+
+/*
+ * autocert.Cache in MetadataDB
+ */
+type acmeDBCache struct{}
+
+func (acmeDBCache) Get(ctx context.Context, name string) ([]byte, error) {
+	var data []byte
+	found := false
+	metaDB.View(func(tx *bolt.Tx) error {
+		found = metaGet(tx, acmeBucket, name, &data)
+		return nil
+	})
+	if !found {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, nil
+}
+
+func (acmeDBCache) Put(ctx context.Context, name string, data []byte) error {
+	return metaDB.Update(func(tx *bolt.Tx) error {
+		return metaPut(tx, acmeBucket, name, data)
+	})
+}
+
+func (acmeDBCache) Delete(ctx context.Context, name string) error {
+	return metaDB.Update(func(tx *bolt.Tx) error {
+		return metaDelete(tx, acmeBucket, name)
+	})
+}
+
+/*
+ * TLS configuration getting certificates over ACME, nil without ACMEDomains
+ */
+func acmeTLSConfig() *tls.Config {
+	if len(conf.ACMEDomains) == 0 {
+		return nil
+	}
+	var cache autocert.Cache = autocert.DirCache(conf.ACMECacheDir)
+	if metaDB != nil {
+		cache = acmeDBCache{}
+	}
+	acmeManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(conf.ACMEDomains...),
+		Cache:      cache,
+		Email:      conf.ACMEEmail,
+	}
+	if conf.ACMEDirectoryURL != "" {
+		acmeManager.Client = &acme.Client{DirectoryURL: conf.ACMEDirectoryURL}
+	}
+	log.Println("Getting certificates over ACME for", conf.ACMEDomains)
+	return acmeManager.TLSConfig()
+}
+
+/*
+ * Answers HTTP-01 challenges on the HTTP listener, if ACME is used
+ */
+func acmeHTTPHandler(fallback http.Handler) http.Handler {
+	if acmeManager == nil {
+		return fallback
+	}
+	return acmeManager.HTTPHandler(fallback)
+}
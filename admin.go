@@ -0,0 +1,107 @@
+package main
+
+/*
+ * Admin API: object removal and the audit log
+ */
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+/*
+ * Removes an object, recording it in the audit log first. action is one of
+ * "delete", "prune" or "quarantine".
+ */
+func removeObject(ctx context.Context, action, who, why, key string) error {
+	info, err := storageStat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := auditRecord(action, who, why, key, info.Size); err != nil {
+		log.Println("Not removing, failed to write audit log:", err)
+		return err
+	}
+	if err := storageRemove(ctx, key); err != nil {
+		return err
+	}
+	recordTombstone(key, action)
+	dropShortLinks(key)
+	forgetUsage(key)
+	cdnPurge(key)
+	postHook(conf.HookPostDelete, "post-delete", hookEvent{
+		"key": key, "size": strconv.FormatInt(info.Size, 10), "action": action, "who": who, "reason": why,
+	})
+	return nil
+}
+
+/*
+ * DELETE /api/objects/<key>?reason=...
+ * The actor can be named in an X-Actor header, for tooling acting on behalf
+ * of a moderator.
+ */
+func handleObjects(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	if r.Method != "DELETE" {
+		http.Error(w, "405 Method Not Allowed", 405)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/api/objects/")
+	reason := r.URL.Query().Get("reason")
+	if key == "" || reason == "" {
+		http.Error(w, "400 Need key and reason", 400)
+		return
+	}
+	who := "api " + r.RemoteAddr
+	if actor := r.Header.Get("X-Actor"); actor != "" {
+		who = actor + " (" + who + ")"
+	}
+
+	if err := removeObject(r.Context(), "delete", who, reason, key); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			http.Error(w, "404 Not Found", 404)
+			return
+		}
+		log.Println("Removing object failed:", err)
+		http.Error(w, "Storage error", 502)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+ * GET /api/audit[?key=...&action=...], returns matching entries and whether
+ * the chain verified
+ */
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	if conf.AuditLog == "" {
+		http.Error(w, "501 No AuditLog configured", 501)
+		return
+	}
+	auditMu.Lock()
+	entries, err := readAuditLog()
+	auditMu.Unlock()
+
+	key, action := r.URL.Query().Get("key"), r.URL.Query().Get("action")
+	matches := []auditEntry{}
+	for _, e := range entries {
+		if (key == "" || e.Key == key) && (action == "" || e.Action == action) {
+			matches = append(matches, e)
+		}
+	}
+	resp := map[string]interface{}{"entries": matches, "valid": err == nil}
+	if err != nil {
+		resp["error"] = err.Error()
+	}
+	writeJSON(w, 200, resp)
+}
@@ -0,0 +1,191 @@
+package main
+
+/*
+ * A small built-in alerter, for operators without a monitoring stack. Every
+ * AlertInterval the error rate (share of requests answered with a 5xx),
+ * backend health and, if AlertStorageUsage is set, the bucket's total size
+ * are checked. When one of them crosses its threshold, and again when it's
+ * back to normal, a notification goes to AlertWebhook (JSON, with a "text"
+ * field for Slack-style chat hooks), AlertXMPPURL (a plain text POST, as
+ * Prosody's mod_post_msg takes) and/or AlertEmail.
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Fewer requests than this in an interval don't make an error rate
+const alertMinRequests = 10
+
+var alertNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "prosody_filer_alert_notifications_total",
+	Help: "Alert notifications sent, by alert, state (firing, resolved) and result.",
+}, []string{"alert", "state", "result"})
+
+var (
+	alertMu           sync.Mutex
+	alertsFiring      = map[string]bool{}
+	alertLastRequests int64
+	alertLastErrors   int64
+	alertUsageChecked time.Time
+)
+
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+type alertNotice struct {
+	Alert    string    `json:"alert"`
+	State    string    `json:"state"`
+	Message  string    `json:"message"`
+	Instance string    `json:"instance"`
+	Time     time.Time `json:"time"`
+	Text     string    `json:"text"`
+}
+
+func alertsEnabled() bool {
+	return conf.AlertWebhook != "" || conf.AlertXMPPURL != "" || len(conf.AlertEmail) > 0
+}
+
+func runAlerter() {
+	if !alertsEnabled() {
+		return
+	}
+	for range time.Tick(conf.AlertInterval) {
+		checkAlerts(time.Now())
+	}
+}
+
+func checkAlerts(now time.Time) {
+	requests := atomic.LoadInt64(&statRequests)
+	errors := atomic.LoadInt64(&statServerErrors)
+	alertMu.Lock()
+	n, failed := requests-alertLastRequests, errors-alertLastErrors
+	alertLastRequests, alertLastErrors = requests, errors
+	alertMu.Unlock()
+
+	if conf.AlertErrorRate > 0 {
+		rate := 0.0
+		if n >= alertMinRequests {
+			rate = float64(failed) / float64(n)
+		}
+		setAlert("error_rate", rate > conf.AlertErrorRate,
+			fmt.Sprintf("%d of %d requests in the last %v failed with a server error (threshold %g%%)", failed, n, conf.AlertInterval, conf.AlertErrorRate*100))
+	}
+	setAlert("storage_down", storageDown(), "Storage backend is unreachable or failing")
+
+	if conf.AlertStorageUsage > 0 && now.Sub(alertUsageChecked) >= conf.AlertUsageInterval {
+		alertUsageChecked = now
+		usage, err := storageUsage(context.Background())
+		if err != nil {
+			log.Println("Can't check storage usage:", err)
+			return
+		}
+		setAlert("storage_usage", usage > conf.AlertStorageUsage,
+			fmt.Sprintf("Bucket %s holds %d bytes (threshold %d)", conf.S3Bucket, usage, conf.AlertStorageUsage))
+	}
+}
+
+func storageUsage(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var total int64
+	for obj := range storageList(ctx, "") {
+		if obj.Err != nil {
+			return 0, obj.Err
+		}
+		total += obj.Size
+	}
+	return total, nil
+}
+
+/*
+ * Notifies if the alert changed state since the last check
+ */
+func setAlert(name string, firing bool, msg string) {
+	alertMu.Lock()
+	changed := alertsFiring[name] != firing
+	alertsFiring[name] = firing
+	alertMu.Unlock()
+	if !changed {
+		return
+	}
+	state := "firing"
+	if !firing {
+		state = "resolved"
+	}
+	host, _ := os.Hostname()
+	notice := alertNotice{
+		Alert:    name,
+		State:    state,
+		Message:  msg,
+		Instance: host,
+		Time:     time.Now(),
+		Text:     fmt.Sprintf("[%s] %s on %s: %s", strings.ToUpper(state), name, host, msg),
+	}
+	log.Println("Alert", notice.Text)
+	sendAlert(notice)
+}
+
+func sendAlert(notice alertNotice) {
+	result := func(err error) {
+		if err != nil {
+			log.Println("Can't send alert notification:", err)
+			alertNotifications.WithLabelValues(notice.Alert, notice.State, "error").Inc()
+		} else {
+			alertNotifications.WithLabelValues(notice.Alert, notice.State, "ok").Inc()
+		}
+	}
+	if conf.AlertWebhook != "" {
+		data, _ := json.Marshal(notice)
+		result(postAlert(conf.AlertWebhook, "application/json", data))
+	}
+	if conf.AlertXMPPURL != "" {
+		result(postAlert(conf.AlertXMPPURL, "text/plain; charset=utf-8", []byte(notice.Text)))
+	}
+	if len(conf.AlertEmail) > 0 {
+		result(mailAlert(notice))
+	}
+}
+
+func postAlert(url, ctype string, body []byte) error {
+	resp, err := alertClient.Post(url, ctype, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func mailAlert(notice alertNotice) error {
+	var auth smtp.Auth
+	if conf.AlertSMTPUser != "" {
+		host := conf.AlertSMTPServer
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", conf.AlertSMTPUser, conf.AlertSMTPPassword, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		conf.AlertEmailFrom, strings.Join(conf.AlertEmail, ", "), notice.Text,
+		notice.Time.Format(time.RFC1123Z), notice.Message)
+	return smtp.SendMail(conf.AlertSMTPServer, auth, conf.AlertEmailFrom, conf.AlertEmail, []byte(msg))
+}
@@ -0,0 +1,57 @@
+package main
+
+/*
+ * JSON API for the XMPP server, bots and admins, authorized by APIToken
+ */
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+/*
+ * Checks the bearer token. The API is disabled entirely without APIToken.
+ */
+func apiAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if conf.APIToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	got := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(got, []byte("Bearer "+conf.APIToken)) != 1 {
+		log.Println("API: unauthorized request from", r.RemoteAddr, r.URL.Path)
+		securityEvent("api_unauthorized")
+		http.Error(w, "401 Unauthorized", 401)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Failed to write JSON response:", err)
+	}
+}
+
+func registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/sessions", handleSessions)
+	mux.HandleFunc("/api/sessions/", handleSessions)
+	mux.HandleFunc("/api/objects/", handleObjects)
+	mux.HandleFunc("/api/audit", handleAudit)
+	mux.HandleFunc("/api/zip", handleZip)
+	mux.HandleFunc("/api/manifests", handleManifests)
+	mux.HandleFunc("/api/manifests/", handleManifests)
+	mux.HandleFunc("/api/check", handleCheck)
+	mux.HandleFunc("/api/usage", handleUsage)
+	mux.HandleFunc("/api/exists", handleExists)
+	mux.HandleFunc("/api/shortlinks", handleShortLinks)
+	mux.HandleFunc("/api/downloads", handleDownloads)
+	mux.HandleFunc("/api/passwords/", handlePasswords)
+	mux.HandleFunc("/stats", handleStats)
+	mux.HandleFunc("/api/drain", handleDrain)
+	mux.HandleFunc("/api/maintenance", handleMaintenance)
+}
@@ -0,0 +1,183 @@
+package main
+
+/*
+ * Append-only audit log of destructive operations (delete, prune,
+ * quarantine). Each entry carries the hash of the previous one, so removing
+ * or editing entries after the fact breaks the chain. These, as well as
+ * uploads and downloads, can also be streamed to syslog (auditstream.go).
+ */
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Who    string    `json:"who"`
+	Why    string    `json:"why"`
+	Key    string    `json:"key"`
+	Size   int64     `json:"size"`
+	Prev   string    `json:"prev"`
+	Hash   string    `json:"hash"`
+}
+
+var (
+	auditMu   sync.Mutex
+	auditFile *os.File
+	auditLast string
+)
+
+func (e auditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+ * Opens the audit log for appending, after checking the existing chain
+ */
+func openAuditLog() {
+	if conf.AuditLog == "" {
+		return
+	}
+	entries, err := readAuditLog()
+	if err != nil {
+		log.Fatalln("Audit log is unreadable or has been tampered with:", err)
+	}
+	if len(entries) > 0 {
+		auditLast = entries[len(entries)-1].Hash
+	}
+	auditFile, err = os.OpenFile(conf.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatalln("Can't open audit log:", err)
+	}
+	log.Printf("Opened audit log %s (%d entries)", conf.AuditLog, len(entries))
+}
+
+/*
+ * Reads and verifies the whole audit log
+ */
+func readAuditLog() ([]auditEntry, error) {
+	f, err := os.Open(conf.AuditLog)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []auditEntry
+	prev := ""
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		var e auditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return entries, fmt.Errorf("line %d: %v", n, err)
+		}
+		if e.Prev != prev || e.Hash != e.computeHash() {
+			return entries, fmt.Errorf("line %d: hash chain broken", n)
+		}
+		prev = e.Hash
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+/*
+ * Records an operation. Must be called, and succeed, before executing it.
+ * Without AuditLog configured this only goes to the regular log.
+ */
+func auditRecord(action, who, why, key string, size int64) error {
+	log.Printf("Audit: %s of %s (%d bytes) by %s: %s", action, key, size, who, why)
+	writeAuditEvent(formatAuditEvent(action,
+		"key", key, "size", strconv.FormatInt(size, 10), "who", who, "why", why))
+	if auditFile == nil {
+		return nil
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	e := auditEntry{
+		Time:   time.Now().UTC(),
+		Action: action,
+		Who:    who,
+		Why:    why,
+		Key:    key,
+		Size:   size,
+		Prev:   auditLast,
+	}
+	e.Hash = e.computeHash()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := auditFile.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := auditFile.Sync(); err != nil {
+		return err
+	}
+	auditLast = e.Hash
+	return nil
+}
+
+/*
+ * Formats an audit event as key=value pairs (values quoted where needed)
+ * for the syslog stream. Field names are stable: event, key, size, status,
+ * class, remote, who, why.
+ */
+func formatAuditEvent(event string, fields ...string) string {
+	line := "event=" + event
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] == "" {
+			continue
+		}
+		v := fields[i+1]
+		if strings.ContainsAny(v, " =") || strconv.QuoteToASCII(v) != `"`+v+`"` {
+			v = strconv.QuoteToASCII(v)
+		}
+		line += " " + fields[i] + "=" + v
+	}
+	return line
+}
+
+/*
+ * Audit events for requests handled by handleRequest
+ */
+func streamRequestAudit(r *http.Request, rec *responseRecorder, body *countingReader) {
+	if conf.AuditSyslog == "" {
+		return
+	}
+	var event string
+	size := body.read
+	switch {
+	case r.Method == "PUT" && rec.status < 300:
+		event = "upload_accepted"
+	case r.Method == "PUT":
+		event = "upload_rejected"
+	case r.Method == "GET" && rec.status < 400:
+		event = "download"
+		size = rec.written
+	default:
+		return
+	}
+	writeAuditEvent(formatAuditEvent(event,
+		"key", strings.TrimPrefix(r.URL.Path, "/"+conf.UploadSubDir),
+		"size", strconv.FormatInt(size, 10),
+		"status", strconv.Itoa(rec.status),
+		"class", rec.class,
+		"remote", r.RemoteAddr))
+}
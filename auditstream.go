@@ -0,0 +1,50 @@
+//go:build !windows && !plan9
+
+package main
+
+/*
+ * Audit events (uploads accepted or rejected, downloads, deletions) sent to
+ * syslog, which also ends up in the journal on systemd machines. These are
+ * separate from the application log and use stable key=value fields so
+ * they can be parsed wherever audit trails are collected.
+ */
+
+import (
+	"log"
+	"log/syslog"
+	"net/url"
+)
+
+var auditSyslog *syslog.Writer
+
+/*
+ * AuditSyslog is "local" for the local syslog daemon or journal, or a URL
+ * like udp://loghost:514 for a remote one
+ */
+func openAuditStream() {
+	if conf.AuditSyslog == "" {
+		return
+	}
+	network, addr := "", ""
+	if conf.AuditSyslog != "local" {
+		u, err := url.Parse(conf.AuditSyslog)
+		if err != nil || u.Host == "" {
+			log.Fatalln("Invalid AuditSyslog, expected \"local\" or e.g. udp://host:514:", conf.AuditSyslog)
+		}
+		network, addr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_AUTH, "prosody-filer-audit")
+	if err != nil {
+		log.Fatalln("Failed to connect to syslog for audit events:", err)
+	}
+	auditSyslog = w
+}
+
+func writeAuditEvent(line string) {
+	if auditSyslog == nil {
+		return
+	}
+	if err := auditSyslog.Info(line); err != nil {
+		log.Println("Failed to send audit event to syslog:", err)
+	}
+}
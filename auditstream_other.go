@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import "log"
+
+func openAuditStream() {
+	if conf.AuditSyslog != "" {
+		log.Fatalln("AuditSyslog is not supported on this platform")
+	}
+}
+
+func writeAuditEvent(line string) {}
@@ -0,0 +1,201 @@
+package main
+
+/*
+ * Upload signature (HMAC) verification
+ */
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/*
+ * A signature scheme: which URL parameter carries the MAC and how to compute
+ * the expected value for a request
+ */
+type macScheme struct {
+	param string
+	sign  func(secret, fileStorePath string, size int64, ctype string) string
+	fips  bool // only uses FIPS approved algorithms
+}
+
+var macSchemes = map[string]macScheme{
+	// mod_http_upload_external v1: HMAC-SHA256 over "<path> <size>"
+	"v1": {"v", func(secret, fileStorePath string, size int64, ctype string) string {
+		return hmacHex(secret, fileStorePath+" "+strconv.FormatInt(size, 10))
+	}, true},
+	// Metronome's mod_http_upload_external: also covers the content type,
+	// space separated
+	"metronome": {"v", func(secret, fileStorePath string, size int64, ctype string) string {
+		return hmacHex(secret, fileStorePath+" "+strconv.FormatInt(size, 10)+" "+ctype)
+	}, true},
+	// mod_http_upload_external v2: also covers the content type, NUL
+	// separated, in its own parameter
+	"v2": {"v2", func(secret, fileStorePath string, size int64, ctype string) string {
+		return hmacHex(secret, fileStorePath+"\x00"+strconv.FormatInt(size, 10)+"\x00"+ctype)
+	}, true},
+}
+
+/*
+ * Scheme "auto" accepts v1 and v2 signatures, whichever the URL carries, so
+ * Prosody can be upgraded without touching the Filer. URLs we sign ourselves
+ * use v2.
+ */
+var autoSchemes = []string{"v2", "v1"}
+
+func init() {
+	macSchemes["auto"] = macSchemes["v2"]
+	// ejabberd's mod_http_upload with external_secret: the v1 format, named
+	// so configuration and capabilities say which server it's meant for
+	macSchemes["ejabberd"] = macSchemes["v1"]
+}
+
+func hmacHex(secret, msg string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * A secret/scheme combination we accept signatures for
+ */
+type macKey struct {
+	name   string // "current" or "previous", used in logs and metrics
+	scheme string
+	secret string
+}
+
+/*
+ * Returns the keys currently accepted. The previous secret/scheme is only
+ * honoured until PreviousUntil so a migration can't silently linger forever.
+ */
+func acceptedMACKeys(now time.Time) []macKey {
+	s := settings()
+	keys := macKeys("current", conf.Scheme, s.Secret)
+	if s.PreviousSecret != "" && now.Before(s.PreviousUntil) {
+		keys = append(keys, macKeys("previous", s.PreviousScheme, s.PreviousSecret)...)
+	}
+	return keys
+}
+
+func macKeys(name, scheme, secret string) []macKey {
+	if scheme != "auto" {
+		return []macKey{{name, scheme, secret}}
+	}
+	var keys []macKey
+	for _, s := range autoSchemes {
+		keys = append(keys, macKey{name, s, secret})
+	}
+	return keys
+}
+
+/*
+ * Whether the URL carries a MAC parameter for any accepted scheme
+ */
+func hasMAC(a url.Values) bool {
+	for _, k := range acceptedMACKeys(time.Now()) {
+		if a.Get(macSchemes[k.scheme].param) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Checks the MAC in the URL against all accepted keys. size and ctype are
+ * what the client declared on upload (or what's stored, for downloads).
+ */
+func verifyMAC(fileStorePath string, size int64, ctype string, a url.Values) bool {
+	for _, k := range acceptedMACKeys(time.Now()) {
+		s := macSchemes[k.scheme]
+		got := a.Get(s.param)
+		if got == "" {
+			continue
+		}
+		expected := s.sign(k.secret, fileStorePath, size, ctype)
+		if hmac.Equal([]byte(expected), []byte(got)) {
+			if k.name != "current" {
+				log.Printf("Accepted MAC using %s secret (scheme %s)", k.name, k.scheme)
+			}
+			macVerifications.WithLabelValues(k.scheme, k.name, "ok").Inc()
+			return true
+		}
+		logSampled("invalid_mac", "Invalid MAC for %s secret (scheme %s), expected: %s", k.name, k.scheme, expected)
+	}
+	macVerifications.WithLabelValues("", "", "invalid").Inc()
+	securityEvent("invalid_mac")
+	return false
+}
+
+/*
+ * Download signatures, for SignedDownloads mode. Prosody only hands out
+ * unsigned GET URLs, so these are minted by us: returned in the Location
+ * header of a successful upload, or by running with -sign-download.
+ * "e" is the expiry as a UNIX timestamp, empty if the link doesn't expire.
+ */
+func signDownload(secret, fileStorePath, expires string) string {
+	return hmacHex(secret, "GET "+fileStorePath+" "+expires)
+}
+
+func downloadQuery(fileStorePath string, now time.Time) url.Values {
+	q := make(url.Values)
+	expires := ""
+	if conf.DownloadLinkValidity > 0 {
+		expires = strconv.FormatInt(now.Add(conf.DownloadLinkValidity).Unix(), 10)
+		q.Set("e", expires)
+	}
+	q.Set("d", signDownload(settings().Secret, fileStorePath, expires))
+	return q
+}
+
+func verifyDownload(fileStorePath string, a url.Values, now time.Time) bool {
+	return verifyLink("download", signDownload, fileStorePath, a, now)
+}
+
+/*
+ * Delete links, for DeleteLinks mode: the same as download links, for the
+ * DELETE method. Minted for the uploader only, in the upload response.
+ */
+func signDelete(secret, fileStorePath, expires string) string {
+	return hmacHex(secret, "DELETE "+fileStorePath+" "+expires)
+}
+
+func deleteQuery(fileStorePath string, now time.Time) url.Values {
+	q := make(url.Values)
+	expires := ""
+	if conf.DeleteLinkValidity > 0 {
+		expires = strconv.FormatInt(now.Add(conf.DeleteLinkValidity).Unix(), 10)
+		q.Set("e", expires)
+	}
+	q.Set("d", signDelete(settings().Secret, fileStorePath, expires))
+	return q
+}
+
+func verifyDelete(fileStorePath string, a url.Values, now time.Time) bool {
+	return verifyLink("delete", signDelete, fileStorePath, a, now)
+}
+
+func verifyLink(kind string, sign func(secret, fileStorePath, expires string) string, fileStorePath string, a url.Values, now time.Time) bool {
+	expires := a.Get("e")
+	if expires != "" {
+		ts, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || now.Unix() > ts {
+			logSampled("invalid_mac", "Expired %s link or malformed expiry: %s", kind, expires)
+			securityEvent("expired_link")
+			return false
+		}
+	}
+	for _, k := range acceptedMACKeys(now) {
+		if hmac.Equal([]byte(sign(k.secret, fileStorePath, expires)), []byte(a.Get("d"))) {
+			return true
+		}
+	}
+	logSampled("invalid_mac", "Invalid %s MAC for %s", kind, fileStorePath)
+	securityEvent("invalid_" + kind + "_mac")
+	return false
+}
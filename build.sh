@@ -5,6 +5,11 @@ VERSIONSTRING="$(git describe --tags --exact-match || git rev-parse --short HEAD
 
 echo "Building version ${VERSIONSTRING} of Prosody-Filer ..."
 
+### FIPS=1 builds with Go's FIPS 140-3 validated crypto module
+if [ "${FIPS}" = "1" ]; then
+	export GOFIPS140=v1.0.0
+fi
+
 ### Compile and link statically
-CGO_ENABLED=0 GOOS=linux go build -a -ldflags "-extldflags '-static' -w -s -X main.versionString=${VERSIONSTRING}" prosody-filer.go
+CGO_ENABLED=0 GOOS=linux go build -a -ldflags "-extldflags '-static' -w -s -X main.versionString=${VERSIONSTRING}" -o prosody-filer .
 
@@ -0,0 +1,207 @@
+package main
+
+/*
+ * Local disk cache of recent uploads, so recent chat media stays viewable
+ * while the storage backend is down: with the circuit breaker open, or a
+ * proxied download failing on a backend error, downloads that are in the
+ * cache are served from it with a Warning header instead of failing.
+ * Uploads up to CacheMaxFileSize are written to CacheDir as they stream
+ * through; the oldest files go once the cache grows beyond CacheSize.
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	cacheMu    sync.Mutex
+	cacheBytes int64
+)
+
+var degradedDownloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "prosody_filer_degraded_downloads_total",
+	Help: "Downloads attempted from the local cache because the backend was unavailable, by result (hit, miss).",
+}, []string{"result"})
+
+func openCache() {
+	if conf.CacheDir == "" {
+		return
+	}
+	if err := os.MkdirAll(conf.CacheDir, 0700); err != nil {
+		log.Fatalln("Can't create CacheDir:", err)
+	}
+	files, err := ioutil.ReadDir(conf.CacheDir)
+	if err != nil {
+		log.Fatalln("Can't read CacheDir:", err)
+	}
+	for _, fi := range files {
+		cacheBytes += fi.Size()
+	}
+	log.Printf("Cache in %s holds %d bytes", conf.CacheDir, cacheBytes)
+}
+
+func cachePath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(conf.CacheDir, hex.EncodeToString(sum[:]))
+}
+
+/*
+ * Collects an upload as it streams through. Never fails a write, a cache
+ * problem mustn't break the upload.
+ */
+type cacheWriter struct {
+	f      *os.File
+	failed bool
+	n      int64
+}
+
+func newCacheWriter(size int64) *cacheWriter {
+	if conf.CacheDir == "" || size > conf.CacheMaxFileSize {
+		return nil
+	}
+	f, err := ioutil.TempFile(conf.CacheDir, ".incoming-")
+	if err != nil {
+		log.Println("Can't cache upload:", err)
+		return nil
+	}
+	return &cacheWriter{f: f}
+}
+
+func (c *cacheWriter) Write(p []byte) (int, error) {
+	if !c.failed {
+		n, err := c.f.Write(p)
+		c.n += int64(n)
+		c.failed = err != nil || c.n > conf.CacheMaxFileSize
+	}
+	return len(p), nil
+}
+
+/*
+ * Moves the complete upload into the cache, or drops it if something went
+ * wrong. Safe to call after commit.
+ */
+func (c *cacheWriter) finish(key string, ok bool) {
+	if c.f == nil {
+		return
+	}
+	name := c.f.Name()
+	if err := c.f.Close(); err != nil {
+		c.failed = true
+	}
+	c.f = nil
+	if !ok || c.failed {
+		os.Remove(name)
+		return
+	}
+	path := cachePath(key)
+	cacheMu.Lock()
+	if fi, err := os.Stat(path); err == nil {
+		cacheBytes -= fi.Size()
+	}
+	if err := os.Rename(name, path); err != nil {
+		cacheMu.Unlock()
+		log.Println("Can't cache upload:", err)
+		os.Remove(name)
+		return
+	}
+	cacheBytes += c.n
+	over := cacheBytes > conf.CacheSize
+	cacheMu.Unlock()
+	if over {
+		evictCache()
+	}
+}
+
+/*
+ * Removes the oldest files until we're below CacheSize again
+ */
+func evictCache() {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	files, err := ioutil.ReadDir(conf.CacheDir)
+	if err != nil {
+		log.Println("Can't read CacheDir:", err)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, fi := range files {
+		if cacheBytes <= conf.CacheSize {
+			return
+		}
+		if fi.Name()[0] == '.' {
+			continue
+		}
+		if err := os.Remove(filepath.Join(conf.CacheDir, fi.Name())); err == nil {
+			cacheBytes -= fi.Size()
+		}
+	}
+}
+
+func uncache(key string) {
+	if conf.CacheDir == "" {
+		return
+	}
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	path := cachePath(key)
+	if fi, err := os.Stat(path); err == nil && os.Remove(path) == nil {
+		cacheBytes -= fi.Size()
+	}
+}
+
+/*
+ * Serves a plain download from the cache while the backend is unavailable.
+ * Returns false if we can't.
+ */
+func serveCached(w http.ResponseWriter, r *http.Request, key string, a url.Values) bool {
+	if conf.CacheDir == "" || (r.Method != "GET" && r.Method != "HEAD") {
+		return false
+	}
+	if isVariantRequest(a) || a.Get("meta") != "" || a.Get("policy") != "" || a.Get("progress") != "" {
+		return false
+	}
+	if conf.SignedDownloads && !downloadAuthorized(r, key, a) {
+		return false
+	}
+	f, err := os.Open(cachePath(key))
+	if err != nil {
+		degradedDownloads.WithLabelValues("miss").Inc()
+		atomic.AddInt64(&statCacheMisses, 1)
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	degradedDownloads.WithLabelValues("hit").Inc()
+	atomic.AddInt64(&statCacheHits, 1)
+	log.Println("Storage unavailable, serving", key, "from cache")
+	addContentHeaders(w.Header(), key)
+	forceDownload(w.Header(), key, a)
+	if conf.DetectOMEMO {
+		// We can't ask the backend how it was stored, but the cache has the
+		// same bytes it was sniffed by
+		head := make([]byte, 512)
+		n, _ := f.ReadAt(head, 0)
+		if looksOpaque(head[:n], w.Header().Get("Content-Type")) {
+			setOpaqueHeaders(w.Header())
+		}
+	}
+	w.Header().Set("Warning", `111 - "Revalidation Failed"`)
+	http.ServeContent(w, r, key, fi.ModTime(), f)
+	return true
+}
@@ -0,0 +1,83 @@
+package main
+
+/*
+ * Capability discovery: GET /.well-known/prosody-filer (or /capabilities)
+ * describes what this server accepts, so clients and the XMPP server can
+ * configure themselves instead of hard-coding limits. Public, as it only
+ * describes behaviour anyone can observe.
+ */
+
+import (
+	"net/http"
+	"time"
+)
+
+type capabilities struct {
+	UploadPath string `json:"upload_path"`
+	// Omitted when there's no limit / files are kept forever
+	MaxUploadSize    int64    `json:"max_upload_size,omitempty"`
+	AllowedTypes     []string `json:"allowed_types,omitempty"`
+	RetentionSeconds int64    `json:"retention_seconds,omitempty"`
+	// Signature schemes for uploads and downloads
+	UploadAuth   []string `json:"upload_auth"`
+	DownloadAuth []string `json:"download_auth"`
+	Features     []string `json:"features"`
+}
+
+func currentCapabilities(now time.Time) capabilities {
+	c := capabilities{
+		UploadPath:       "/" + conf.UploadSubDir,
+		MaxUploadSize:    conf.MaxUploadSize,
+		RetentionSeconds: int64(settings().RetentionDays) * 24 * 60 * 60,
+		AllowedTypes:     conf.AllowedTypes,
+		UploadAuth:       []string{},
+		DownloadAuth:     []string{},
+		Features:         []string{"force_download"},
+	}
+	if conf.RequireUploadSessions {
+		c.UploadAuth = append(c.UploadAuth, "session")
+	} else {
+		for _, k := range acceptedMACKeys(now) {
+			c.UploadAuth = append(c.UploadAuth, k.scheme)
+		}
+	}
+	if conf.SecureLinkMD5 != "" {
+		c.UploadAuth = append(c.UploadAuth, "secure_link")
+	}
+	if conf.SignedDownloads {
+		c.DownloadAuth = append(c.DownloadAuth, "download_mac", "upload_mac")
+		if conf.SecureLinkMD5 != "" {
+			c.DownloadAuth = append(c.DownloadAuth, "secure_link")
+		}
+	}
+	if conf.FilePasswords {
+		c.DownloadAuth = append(c.DownloadAuth, "password")
+	}
+
+	features := []struct {
+		on   bool
+		name string
+	}{
+		{conf.ResumableUploads, "resumable"},
+		{conf.Thumbnails, "thumbnails"},
+		{conf.ProgressEvents, "progress_events"},
+		{conf.PresignedPost, "presigned_post"},
+		{conf.ShortLinks, "short_links"},
+		{conf.IdempotentUploads, "idempotent_uploads"},
+		{conf.SkipIdenticalUploads, "skip_identical_uploads"},
+		{conf.FilePasswords, "file_passwords"},
+		{conf.DeleteLinks, "delete_links"},
+		{true, "metadata"},
+	}
+	for _, f := range features {
+		if f.on {
+			c.Features = append(c.Features, f.name)
+		}
+	}
+	return c
+}
+
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	addCORSheaders(w)
+	writeJSON(w, 200, currentCapabilities(time.Now()))
+}
@@ -0,0 +1,122 @@
+package main
+
+/*
+ * Keeping a CDN in front of the download domain consistent: removed files
+ * are purged from its edge caches, and with CDNPrefetch new uploads are
+ * fetched through it once so the first recipients get them from the edge.
+ * CDNProvider says how to talk to it:
+ *
+ *  - "cloudflare" purges through the API of zone CDNZone, with CDNToken
+ *  - "fastly" sends PURGE requests for the URL, with CDNToken as Fastly-Key
+ *  - "webhook" POSTs {"action": "purge"/"prefetch", "url": ...} to
+ *    CDNWebhook and leaves the rest to it
+ *
+ * Files are addressed as CDNBaseURL plus their download path. All of this
+ * happens in the background; failures are logged and counted, but don't
+ * affect the upload or removal.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var cdnRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "prosody_filer_cdn_requests_total",
+	Help: "CDN purge and prefetch calls, by action and result.",
+}, []string{"action", "result"})
+
+var (
+	cloudflareAPI = "https://api.cloudflare.com/client/v4"
+	cdnClient     = &http.Client{Timeout: 30 * time.Second}
+)
+
+/*
+ * The URL the CDN serves a file under
+ */
+func cdnURL(key string) string {
+	u := url.URL{Path: "/" + conf.UploadSubDir + key}
+	return strings.TrimSuffix(conf.CDNBaseURL, "/") + u.EscapedPath()
+}
+
+func cdnPurge(key string) {
+	if conf.CDNProvider == "" {
+		return
+	}
+	go cdnRun("purge", key, cdnURL(key))
+}
+
+func cdnPrefetch(key string) {
+	if conf.CDNProvider == "" || !conf.CDNPrefetch {
+		return
+	}
+	target := cdnURL(key)
+	if conf.SignedDownloads {
+		target += "?" + downloadQuery(key, time.Now()).Encode()
+	}
+	go cdnRun("prefetch", key, target)
+}
+
+func cdnRun(action, key, target string) {
+	if err := cdnCall(action, target); err != nil {
+		log.Printf("CDN %s of %s failed: %v", action, key, err)
+		cdnRequests.WithLabelValues(action, "error").Inc()
+		return
+	}
+	cdnRequests.WithLabelValues(action, "ok").Inc()
+}
+
+func cdnCall(action, target string) error {
+	var req *http.Request
+	var err error
+	switch {
+	case conf.CDNProvider == "webhook":
+		body, _ := json.Marshal(map[string]string{"action": action, "url": target})
+		req, err = http.NewRequest("POST", conf.CDNWebhook, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	case action == "prefetch":
+		req, err = http.NewRequest("GET", target, nil)
+	case conf.CDNProvider == "cloudflare":
+		body, _ := json.Marshal(map[string][]string{"files": {target}})
+		req, err = http.NewRequest("POST", cloudflareAPI+"/zones/"+url.PathEscape(conf.CDNZone)+"/purge_cache", bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+conf.CDNToken)
+		}
+	case conf.CDNProvider == "fastly":
+		req, err = http.NewRequest("PURGE", target, nil)
+		if err == nil && conf.CDNToken != "" {
+			req.Header.Set("Fastly-Key", conf.CDNToken)
+		}
+	default:
+		return fmt.Errorf("unknown CDNProvider %q", conf.CDNProvider)
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := cdnClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	// A prefetch is only done once the edge has all of it
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+/*
+ * Chaos testing of client aborts: with ChaosAbortRate set, that fraction of
+ * requests gets its connection dropped partway through the upload or
+ * download, to check that partial multipart uploads, spool files and
+ * reservations get cleaned up no matter where a client goes away. For
+ * testing only.
+ */
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var errChaosAbort = errors.New("chaos: client connection dropped")
+
+var chaosAborts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "prosody_filer_chaos_aborts_total",
+	Help: "Requests cut off by ChaosAbortRate, by direction.",
+}, []string{"direction"})
+
+type chaosReader struct {
+	io.ReadCloser
+	left int64
+}
+
+func (c *chaosReader) Read(p []byte) (int, error) {
+	if c.left <= 0 {
+		chaosAborts.WithLabelValues("in").Inc()
+		return 0, errChaosAbort
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.ReadCloser.Read(p)
+	c.left -= int64(n)
+	return n, err
+}
+
+type chaosWriter struct {
+	http.ResponseWriter
+	left int64 // -1 until the first write
+}
+
+func (c *chaosWriter) Write(p []byte) (int, error) {
+	if c.left < 0 {
+		// Somewhere in the response, if we know how long it'll be
+		size, err := strconv.ParseInt(c.Header().Get("Content-Length"), 10, 64)
+		if err != nil || size <= 0 {
+			size = 1 << 20
+		}
+		c.left = rand.Int63n(size)
+	}
+	if int64(len(p)) > c.left {
+		c.ResponseWriter.Write(p[:c.left])
+		chaosAborts.WithLabelValues("out").Inc()
+		// Makes net/http drop the connection
+		panic(http.ErrAbortHandler)
+	}
+	c.left -= int64(len(p))
+	return c.ResponseWriter.Write(p)
+}
+
+/*
+ * Sets a fraction of requests up to be cut off at a random point
+ */
+func chaos(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	if conf.ChaosAbortRate <= 0 || rand.Float64() >= conf.ChaosAbortRate {
+		return w, r
+	}
+	if r.Body != nil && r.ContentLength > 0 {
+		r.Body = &chaosReader{ReadCloser: r.Body, left: rand.Int63n(r.ContentLength)}
+		return w, r
+	}
+	return &chaosWriter{ResponseWriter: w, left: -1}, r
+}
@@ -0,0 +1,204 @@
+package main
+
+/*
+ * Chunked uploads (ChunkedUploads), for clients that can't keep a single
+ * connection open long enough: the file is sent as numbered chunk PUTs
+ *
+ *   PUT  /upload/<path>?v=<mac>&chunk=<n>      (n = 1, 2, ...)
+ *   POST /upload/<path>?v=<mac>&compose=<count>
+ *
+ * both with an Upload-Length header holding the full size, which is what
+ * the MAC covers. The compose call concatenates the chunks server-side (S3
+ * multipart copy), so all chunks but the last must be at least 5 MiB. Chunks
+ * that are never composed are removed after MultipartMaxAge.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+// Chunks are staged under this prefix, which isn't reachable from outside
+const chunkPrefix = ".chunks/"
+
+// S3's limit on the number of parts
+const maxChunks = 10000
+
+func chunkKey(fileStorePath string, n int) string {
+	return fmt.Sprintf("%s%s/%d", chunkPrefix, fileStorePath, n)
+}
+
+func isReservedKey(fileStorePath string) bool {
+	return strings.HasPrefix(fileStorePath, chunkPrefix)
+}
+
+/*
+ * Checks the MAC against the full size from Upload-Length and admits the
+ * upload like a PUT, returns that size and the chunk number/count from the
+ * given parameter
+ */
+func verifyChunkRequest(w http.ResponseWriter, r *http.Request, fileStorePath string, a url.Values, param string) (int64, int, effectivePolicy, hookEvent, bool) {
+	var pol effectivePolicy
+	if !conf.ChunkedUploads || encryptionKey != nil {
+		httpError(w, "bad_request", "400 Chunked uploads not enabled", 400)
+		return 0, 0, pol, nil, false
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	n, err2 := strconv.Atoi(a.Get(param))
+	if err != nil || err2 != nil || size < 0 || n < 1 || n > maxChunks {
+		httpError(w, "bad_request", "400 Bad Request", 400)
+		return 0, 0, pol, nil, false
+	}
+	if conf.RequireUploadSessions {
+		// Sessions are for a single PUT
+		log.Println("Error: No upload session in URL.")
+		securityEvent("session_rejected")
+		httpError(w, "session", "Needs upload session", 403)
+		return 0, 0, pol, nil, false
+	}
+	if !verifyMAC(fileStorePath, size, r.Header.Get("Content-Type"), a) {
+		httpError(w, "invalid_mac", "403 Forbidden", 403)
+		return 0, 0, pol, nil, false
+	}
+	pol, ev, ok := acceptUpload(w, r, fileStorePath, size, r.Header.Get("Content-Type"))
+	return size, n, pol, ev, ok
+}
+
+/*
+ * Bytes staged for the file so far, not counting chunk n (which may be sent
+ * again)
+ */
+func stagedChunkBytes(ctx context.Context, fileStorePath string, n int) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var total int64
+	for obj := range storageList(ctx, chunkPrefix+fileStorePath+"/") {
+		if obj.Err != nil {
+			return total, obj.Err
+		}
+		if obj.Key != chunkKey(fileStorePath, n) {
+			total += obj.Size
+		}
+	}
+	return total, nil
+}
+
+func handleChunk(w http.ResponseWriter, r *http.Request, fileStorePath string, a url.Values) {
+	size, n, _, _, ok := verifyChunkRequest(w, r, fileStorePath, a, "chunk")
+	if !ok {
+		return
+	}
+	if r.ContentLength < 0 || r.ContentLength > size {
+		httpError(w, "bad_request", "400 Bad chunk size", 400)
+		return
+	}
+	// Don't stage more than was signed for, however it's split up
+	staged, err := stagedChunkBytes(context.Background(), fileStorePath, n)
+	if err != nil {
+		log.Println("Listing chunks failed:", err)
+		httpError(w, storageErrorClass(err), "Backend Error", 502)
+		return
+	}
+	if staged+r.ContentLength > size {
+		log.Printf("Chunk %d of %s would make %d bytes, signed for %d", n, fileStorePath, staged+r.ContentLength, size)
+		httpError(w, "length_mismatch", "400 Chunks exceed the signed size", 400)
+		return
+	}
+	exact := &exactReader{r: r.Body, remaining: r.ContentLength}
+	_, err = storagePut(context.Background(), chunkKey(fileStorePath, n), exact, r.ContentLength, minio.PutObjectOptions{})
+	if exact.mismatch {
+		log.Println("Uploading chunk failed:", errLengthMismatch)
+		httpError(w, "length_mismatch", "400 Body doesn't match Content-Length", 400)
+		return
+	} else if err != nil {
+		log.Println("Uploading chunk failed:", err)
+		httpError(w, storageErrorClass(err), "Backend Error", 502)
+		return
+	}
+	logRequestf("Stored chunk %d of %s", n, fileStorePath)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleCompose(w http.ResponseWriter, r *http.Request, fileStorePath string, a url.Values) {
+	size, count, pol, ev, ok := verifyChunkRequest(w, r, fileStorePath, a, "compose")
+	if !ok {
+		return
+	}
+	ctx := context.Background()
+
+	// Check the chunks add up to what was signed before creating anything
+	var srcs []minio.CopySrcOptions
+	var total int64
+	for i := 1; i <= count; i++ {
+		info, err := storageStat(ctx, chunkKey(fileStorePath, i))
+		if err != nil {
+			log.Printf("Chunk %d of %s: %v", i, fileStorePath, err)
+			httpError(w, "bad_request", fmt.Sprintf("400 Missing chunk %d", i), 400)
+			return
+		}
+		total += info.Size
+		srcs = append(srcs, minio.CopySrcOptions{Bucket: conf.S3Bucket, Object: info.Key})
+	}
+	if total != size {
+		log.Printf("Chunks of %s add up to %d bytes, signed for %d", fileStorePath, total, size)
+		httpError(w, "length_mismatch", "400 Chunks don't add up to the signed size", 400)
+		return
+	}
+
+	ch := make(http.Header)
+	addContentHeaders(ch, fileStorePath)
+	dst := minio.CopyDestOptions{
+		Bucket:             conf.S3Bucket,
+		Object:             fileStorePath,
+		ContentType:        ch.Get("Content-Type"),
+		ContentDisposition: ch.Get("Content-Disposition"),
+		ReplaceMetadata:    true,
+	}
+	if _, err := storageCompose(ctx, dst, srcs); err != nil {
+		log.Println("Composing chunks failed:", err)
+		httpError(w, storageErrorClass(err), "Backend Error", 502)
+		return
+	}
+	for _, src := range srcs {
+		if err := storageRemove(ctx, src.Object); err != nil {
+			log.Println("Failed to remove chunk:", err)
+		}
+	}
+
+	logRequestf("Composed %s from %d chunks", fileStorePath, count)
+	finishUpload(fileStorePath, size, dst.ContentType, pol, ev, sniffStored(ctx, fileStorePath))
+	if conf.SignedDownloads {
+		w.Header().Set("Location", signedDownloadURL(fileStorePath))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+/*
+ * A composed file never passed through us, so it's read back for its hash
+ * and metadata if anything needs them. Returns nil if not, or if that fails.
+ */
+func sniffStored(ctx context.Context, fileStorePath string) *metaSniffer {
+	if metaDB == nil && conf.HookPostUpload == "" {
+		return nil
+	}
+	obj, err := storageGet(ctx, fileStorePath)
+	if err != nil {
+		log.Println("Reading back composed file failed:", err)
+		return nil
+	}
+	defer obj.Close()
+	sniff := newMetaSniffer()
+	if _, err := io.Copy(sniff, obj); err != nil {
+		log.Println("Reading back composed file failed:", err)
+		return nil
+	}
+	return sniff
+}
@@ -0,0 +1,320 @@
+package main
+
+/*
+ * XEP-0363 without mod_http_upload_external: with ComponentJID set, we
+ * connect to the XMPP server as an external component (XEP-0114) and hand
+ * out upload slots ourselves, signed with our own secret like the ones for
+ * the web upload page. The XMPP server only needs the component configured,
+ * e.g. in Prosody:
+ *
+ *   Component "upload.example.com"
+ *       component_secret = "..."
+ *
+ * ComponentURL is where clients reach this server over HTTPS. Only users of
+ * ComponentDomains get slots (by default the domain the component is under,
+ * example.com for upload.example.com). Uploads are stored under a hash of the
+ * requesting user's bare JID, so the per-user checks see them as one user.
+ */
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	nsComponent = "jabber:component:accept"
+	nsStreams   = "http://etherx.jabber.org/streams"
+	nsStanzas   = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	nsUpload    = "urn:xmpp:http:upload:0"
+	nsDiscoInfo = "http://jabber.org/protocol/disco#info"
+	nsPing      = "urn:xmpp:ping"
+)
+
+var componentSlots = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "prosody_filer_component_slots_total",
+	Help: "XEP-0363 slot requests answered by the component, by result.",
+}, []string{"result"})
+
+type slotRequest struct {
+	Filename    string `xml:"filename,attr"`
+	Size        int64  `xml:"size,attr"`
+	ContentType string `xml:"content-type,attr"`
+}
+
+type componentIQ struct {
+	XMLName   xml.Name     `xml:"iq"`
+	ID        string       `xml:"id,attr"`
+	Type      string       `xml:"type,attr"`
+	From      string       `xml:"from,attr"`
+	To        string       `xml:"to,attr"`
+	Request   *slotRequest `xml:"urn:xmpp:http:upload:0 request"`
+	DiscoInfo *struct {
+		Node string `xml:"node,attr"`
+	} `xml:"http://jabber.org/protocol/disco#info query"`
+	Ping *struct{} `xml:"urn:xmpp:ping ping"`
+}
+
+/*
+ * Keeps the component connected, reconnecting with backoff
+ */
+func runComponent() {
+	if conf.ComponentJID == "" {
+		return
+	}
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := componentSession()
+		log.Println("Component connection to", conf.ComponentServer, "lost:", err)
+		if time.Since(start) > time.Minute {
+			delay = time.Second
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > 5*time.Minute {
+			delay = 5 * time.Minute
+		}
+	}
+}
+
+func componentSession() error {
+	conn, err := net.DialTimeout("tcp", conf.ComponentServer, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	dec := xml.NewDecoder(conn)
+	if err := componentHandshake(conn, dec); err != nil {
+		return err
+	}
+	log.Println("Connected to", conf.ComponentServer, "as component", conf.ComponentJID)
+	return componentServe(conn, dec)
+}
+
+/*
+ * XEP-0114: the stream id from the server, hashed with the shared secret
+ */
+func componentHandshake(w io.Writer, dec *xml.Decoder) error {
+	_, err := fmt.Fprintf(w, "<?xml version='1.0'?><stream:stream xmlns='%s' xmlns:stream='%s' to='%s'>",
+		nsComponent, nsStreams, xmlEscape(conf.ComponentJID))
+	if err != nil {
+		return err
+	}
+	start, err := nextElement(dec)
+	if err != nil {
+		return err
+	}
+	if start.Name.Space != nsStreams || start.Name.Local != "stream" {
+		return fmt.Errorf("unexpected <%s> instead of stream header", start.Name.Local)
+	}
+	var id string
+	for _, a := range start.Attr {
+		if a.Name.Local == "id" {
+			id = a.Value
+		}
+	}
+	sum := sha1.Sum([]byte(id + conf.ComponentSecret))
+	if _, err := fmt.Fprintf(w, "<handshake>%s</handshake>", hex.EncodeToString(sum[:])); err != nil {
+		return err
+	}
+	reply, err := nextElement(dec)
+	if err != nil {
+		return err
+	}
+	if reply.Name.Local != "handshake" {
+		return streamError(dec, reply)
+	}
+	return dec.Skip()
+}
+
+func componentServe(w io.Writer, dec *xml.Decoder) error {
+	for {
+		start, err := nextElement(dec)
+		if err != nil {
+			return err
+		}
+		if start.Name.Space == nsStreams {
+			return streamError(dec, start)
+		}
+		if start.Name.Local != "iq" {
+			if err := dec.Skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		var iq componentIQ
+		if err := dec.DecodeElement(&iq, &start); err != nil {
+			return err
+		}
+		if reply := componentReply(&iq, time.Now()); reply != "" {
+			if _, err := io.WriteString(w, reply); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func nextElement(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			return xml.StartElement{}, errors.New("stream closed by server")
+		}
+	}
+}
+
+func streamError(dec *xml.Decoder, start xml.StartElement) error {
+	var e struct {
+		Inner []byte `xml:",innerxml"`
+	}
+	dec.DecodeElement(&e, &start)
+	return fmt.Errorf("stream error: %s", bytes.TrimSpace(e.Inner))
+}
+
+/*
+ * The answer to an IQ, empty for results and errors sent to us
+ */
+func componentReply(iq *componentIQ, now time.Time) string {
+	if iq.Type != "get" && iq.Type != "set" {
+		return ""
+	}
+	switch {
+	case iq.Request != nil && iq.Type == "get":
+		put, get, rej := componentSlot(iq.From, iq.Request.Filename, iq.Request.Size, iq.Request.ContentType)
+		if rej != nil {
+			log.Printf("Component: refused slot for %s to %s: %s", iq.Request.Filename, iq.From, rej.reason)
+			componentSlots.WithLabelValues(rej.class).Inc()
+			errType, condition := "modify", "not-acceptable"
+			switch rej.status {
+			case 400:
+				condition = "bad-request"
+			case 403:
+				errType, condition = "auth", "forbidden"
+			case 429, 503, 507:
+				errType, condition = "wait", "resource-constraint"
+			}
+			extra := ""
+			if rej.status == 413 && conf.MaxUploadSize > 0 {
+				extra = fmt.Sprintf("<file-too-large xmlns='%s'><max-file-size>%d</max-file-size></file-too-large>", nsUpload, conf.MaxUploadSize)
+			}
+			return iqError(iq, errType, condition, rej.reason, extra)
+		}
+		log.Printf("Component: slot for %s (%d bytes) issued to %s", iq.Request.Filename, iq.Request.Size, iq.From)
+		componentSlots.WithLabelValues("ok").Inc()
+		return iqResult(iq, fmt.Sprintf("<slot xmlns='%s'><put url='%s'/><get url='%s'/></slot>", nsUpload, xmlEscape(put), xmlEscape(get)))
+	case iq.DiscoInfo != nil && iq.Type == "get" && iq.DiscoInfo.Node == "":
+		form := ""
+		if conf.MaxUploadSize > 0 {
+			// XEP-0363 section 3: announced in a XEP-0128 form
+			form = fmt.Sprintf("<x xmlns='jabber:x:data' type='result'><field var='FORM_TYPE' type='hidden'><value>%s</value></field><field var='max-file-size'><value>%d</value></field></x>",
+				nsUpload, conf.MaxUploadSize)
+		}
+		return iqResult(iq, fmt.Sprintf("<query xmlns='%s'><identity category='store' type='file' name='HTTP File Upload'/><feature var='%s'/><feature var='%s'/>%s</query>",
+			nsDiscoInfo, nsDiscoInfo, nsUpload, form))
+	case iq.Ping != nil && iq.Type == "get":
+		return iqResult(iq, "")
+	}
+	return iqError(iq, "cancel", "service-unavailable", "", "")
+}
+
+/*
+ * Whether the JID is of a user allowed to get slots
+ */
+func componentUser(jid string) bool {
+	domains := conf.ComponentDomains
+	if len(domains) == 0 {
+		parent := conf.ComponentJID
+		if i := strings.Index(parent, "."); i >= 0 {
+			parent = parent[i+1:]
+		}
+		domains = []string{parent}
+	}
+	bare := strings.SplitN(jid, "/", 2)[0]
+	if i := strings.LastIndex(bare, "@"); i >= 0 {
+		bare = bare[i+1:]
+	}
+	for _, d := range domains {
+		if strings.EqualFold(bare, d) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Signed upload and download URLs for a slot, the same way the web upload
+ * page gets them
+ */
+func componentSlot(from, filename string, size int64, ctype string) (string, string, *uploadRejection) {
+	if !componentUser(from) {
+		return "", "", &uploadRejection{403, "forbidden", "Not allowed to upload here"}
+	}
+	if inMaintenance() {
+		return "", "", &uploadRejection{503, "maintenance", conf.MaintenanceMessage}
+	}
+	name := path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if name == "." || name == "/" || strings.HasPrefix(name, ".") || size < 0 {
+		return "", "", &uploadRejection{400, "bad_request", "Invalid file name or size"}
+	}
+	bare := strings.ToLower(strings.SplitN(from, "/", 2)[0])
+	sum := sha256.Sum256([]byte(bare))
+	user := hex.EncodeToString(sum[:8])
+	fileStorePath := path.Join(user, randomToken(), name)
+	if rej := checkUpload(user, fileStorePath, size); rej != nil {
+		return "", "", rej
+	}
+
+	base := strings.TrimSuffix(conf.ComponentURL, "/")
+	put := url.URL{Path: "/" + conf.UploadSubDir + fileStorePath}
+	q := url.Values{macSchemes[conf.Scheme].param: {macSchemes[conf.Scheme].sign(settings().Secret, fileStorePath, size, ctype)}}
+	put.RawQuery = q.Encode()
+	get := (&url.URL{Path: "/" + conf.UploadSubDir + fileStorePath}).String()
+	if conf.SignedDownloads {
+		get = signedDownloadURL(fileStorePath)
+	}
+	return base + put.String(), base + get, nil
+}
+
+func iqResult(iq *componentIQ, payload string) string {
+	return fmt.Sprintf("<iq type='result' id='%s' from='%s' to='%s'>%s</iq>",
+		xmlEscape(iq.ID), xmlEscape(iq.To), xmlEscape(iq.From), payload)
+}
+
+/*
+ * An error reply; extra is any application specific condition element
+ */
+func iqError(iq *componentIQ, errType, condition, text, extra string) string {
+	payload := fmt.Sprintf("<error type='%s'><%s xmlns='%s'/>", errType, condition, nsStanzas)
+	if text != "" {
+		payload += fmt.Sprintf("<text xmlns='%s'>%s</text>", nsStanzas, xmlEscape(text))
+	}
+	payload += extra
+	return fmt.Sprintf("<iq type='error' id='%s' from='%s' to='%s'>%s</error></iq>",
+		xmlEscape(iq.ID), xmlEscape(iq.To), xmlEscape(iq.From), payload)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,168 @@
+package main
+
+/*
+ * Transparent gzip compression at rest for text-like uploads (CompressText).
+ * Objects are stored with Content-Encoding: gzip and their original size in
+ * the Original-Size metadata field. When proxying we pass the compressed
+ * data on to clients that accept gzip and decompress for those that don't.
+ * Compression happens before encryption (see encrypt.go), if both are on.
+ */
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+func isCompressible(ctype string) bool {
+	ctype = strings.TrimSpace(strings.SplitN(ctype, ";", 2)[0])
+	switch ctype {
+	case "application/json", "application/xml", "application/javascript", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(ctype, "text/")
+}
+
+/*
+ * The reading end of a body transformed in a goroutine. Close stops the
+ * goroutine and waits for it to be done with the original body, which
+ * mustn't be read anymore once the handler returns.
+ */
+type pipeBody struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func newPipeBody(transform func(w io.Writer) error) pipeBody {
+	pr, pw := io.Pipe()
+	p := pipeBody{pr, make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		pw.CloseWithError(transform(pw))
+	}()
+	return p
+}
+
+func (p pipeBody) Close() error {
+	err := p.PipeReader.Close()
+	<-p.done
+	return err
+}
+
+/*
+ * Returns a reader with the gzipped contents of body. Close it when done,
+ * whether or not it was read to the end.
+ */
+func compressBody(body io.Reader) io.ReadCloser {
+	return newPipeBody(func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		if _, err := io.Copy(gz, body); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+}
+
+/*
+ * Whether an existing object was stored compressed. Objects uploaded before
+ * CompressText was enabled weren't.
+ */
+func isStoredCompressed(info minio.ObjectInfo) bool {
+	return info.Metadata.Get("Content-Encoding") == "gzip"
+}
+
+/*
+ * Proxies a compressed and/or encrypted object. Returns false if the object
+ * is stored as-is, so the caller should serve it as usual.
+ */
+func serveEncoded(w http.ResponseWriter, r *http.Request, fileStorePath string, obj StorageObject) bool {
+	info, err := obj.Stat()
+	if err != nil {
+		return false
+	}
+	gz, enc := isStoredCompressed(info), isStoredEncrypted(info)
+	if !gz && !enc {
+		return false
+	}
+
+	var body io.Reader = obj
+	if enc {
+		body = decryptBody(obj)
+	}
+	passthrough := false
+	if gz {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			if !enc {
+				if r.Method == "GET" {
+					http.ServeContent(w, r, fileStorePath, time.Now(), obj)
+				}
+				return true
+			}
+			// Decrypted but still compressed, we don't know that size
+			passthrough, gz = true, false
+		}
+	}
+
+	if size := info.Metadata.Get("X-Amz-Meta-Original-Size"); size != "" && !passthrough {
+		w.Header().Set("Content-Length", size)
+	}
+	if r.Method == "HEAD" {
+		return true
+	}
+	if gz {
+		if body, err = gzip.NewReader(body); err != nil {
+			log.Println("Stored object is not valid gzip:", err)
+			httpError(w, "backend_error", "Storage error", 502)
+			return true
+		}
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Println("Failed to send object:", err)
+	}
+	return true
+}
+
+/*
+ * Returns the original contents of a stored object, undoing encryption and
+ * compression if needed
+ */
+func plainReader(obj io.Reader, info minio.ObjectInfo) (io.Reader, error) {
+	if isStoredEncrypted(info) {
+		obj = decryptBody(obj)
+	}
+	if isStoredCompressed(info) {
+		return gzip.NewReader(obj)
+	}
+	return obj, nil
+}
+
+/*
+ * Size of the original contents of a stored object
+ */
+func plainSize(info minio.ObjectInfo) int64 {
+	if size, err := strconv.ParseInt(info.Metadata.Get("X-Amz-Meta-Original-Size"), 10, 64); err == nil {
+		return size
+	}
+	return info.Size
+}
+
+/*
+ * Sets up the upload options for storing compressed, returning the body and
+ * size to pass to PutObject. The body needs closing as for compressBody.
+ */
+func compressUpload(opt *minio.PutObjectOptions, body io.Reader, size int64) (io.ReadCloser, int64) {
+	opt.ContentEncoding = "gzip"
+	if opt.UserMetadata == nil {
+		opt.UserMetadata = make(map[string]string)
+	}
+	opt.UserMetadata["Original-Size"] = strconv.FormatInt(size, 10)
+	return compressBody(body), -1
+}
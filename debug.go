@@ -0,0 +1,102 @@
+package main
+
+/*
+ * Debug mode: for a sample of requests (DebugSampleRate), log everything
+ * about the request and response with auth headers redacted, plus notes
+ * added along the way like which keys the MAC matched and which storage
+ * operation we picked. Meant for "why does Prosody's signature get rejected".
+ */
+
+import (
+	"context"
+	"crypto/hmac"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type debugKey struct{}
+
+type debugInfo struct {
+	notes []string
+}
+
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+/*
+ * Decides whether to debug this request, returning the request to use
+ */
+func startDebug(r *http.Request) *http.Request {
+	if s := settings(); !s.Debug || rand.Float64() >= s.DebugSampleRate {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), debugKey{}, &debugInfo{}))
+}
+
+func debugging(r *http.Request) bool {
+	return r.Context().Value(debugKey{}) != nil
+}
+
+func debugNote(r *http.Request, format string, v ...interface{}) {
+	if d, ok := r.Context().Value(debugKey{}).(*debugInfo); ok {
+		d.notes = append(d.notes, fmt.Sprintf(format, v...))
+	}
+}
+
+func formatHeaders(h http.Header) string {
+	var keys []string
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		v := strings.Join(h[k], ", ")
+		if redactedHeaders[k] {
+			v = "[redacted]"
+		}
+		fmt.Fprintf(&b, "\n    %s: %s", k, v)
+	}
+	return b.String()
+}
+
+func finishDebug(r *http.Request, rec *responseRecorder) {
+	d, ok := r.Context().Value(debugKey{}).(*debugInfo)
+	if !ok {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "DEBUG %s %s from %s (Content-Length %d)", r.Method, loggableURL(r.URL), r.RemoteAddr, r.ContentLength)
+	fmt.Fprintf(&b, "\n  request headers:%s", formatHeaders(r.Header))
+	for _, n := range d.notes {
+		fmt.Fprintf(&b, "\n  %s", n)
+	}
+	fmt.Fprintf(&b, "\n  response %d, %d bytes, headers:%s", rec.status, rec.written, formatHeaders(rec.Header()))
+	log.Println(b.String())
+}
+
+/*
+ * Notes whether the MAC the client sent matches each accepted key. Never the
+ * expected MAC itself: whoever reads the log could upload with it.
+ */
+func debugMAC(r *http.Request, fileStorePath string, size int64, ctype string) {
+	if !debugging(r) {
+		return
+	}
+	q := r.URL.Query()
+	for _, k := range acceptedMACKeys(time.Now()) {
+		s := macSchemes[k.scheme]
+		matched := hmac.Equal([]byte(q.Get(s.param)), []byte(s.sign(k.secret, fileStorePath, size, ctype)))
+		debugNote(r, "MAC (%s secret, scheme %s) over path %q size %d type %q: matched %v",
+			k.name, k.scheme, fileStorePath, size, ctype, matched)
+	}
+}
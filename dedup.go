@@ -0,0 +1,91 @@
+package main
+
+/*
+ * Pre-existence checks for slot issuers: before handing out a slot, the XMPP
+ * server can ask whether a key, or a file with a given SHA-256, is already
+ * stored, and hand out the existing URL instead of having the client upload
+ * it again. Content hashes are indexed in MetadataDB as uploads complete.
+ */
+
+import (
+	"context"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+	bolt "go.etcd.io/bbolt"
+)
+
+const hashBucket = "hashes"
+
+/*
+ * Remembers the SHA-256 of a completed upload. Best effort: a failure here
+ * only means a missed dedup opportunity.
+ */
+func recordHash(key, sum string) {
+	if metaDB == nil {
+		return
+	}
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		return metaPut(tx, hashBucket, sum, key)
+	})
+	if err != nil {
+		log.Println("Failed to record content hash:", err)
+	}
+}
+
+func lookupHash(sum string) (key string, found bool) {
+	metaDB.View(func(tx *bolt.Tx) error {
+		found = metaGet(tx, hashBucket, sum, &key)
+		return nil
+	})
+	return key, found
+}
+
+/*
+ * GET /api/exists?key=<path> or ?sha256=<hex>
+ */
+func handleExists(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	key := q.Get("key")
+	if sum := strings.ToLower(q.Get("sha256")); sum != "" {
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != 32 {
+			http.Error(w, "400 Invalid sha256", 400)
+			return
+		}
+		if metaDB == nil {
+			http.Error(w, "501 Hash lookups need MetadataDB", 501)
+			return
+		}
+		var found bool
+		if key, found = lookupHash(sum); !found {
+			writeJSON(w, 200, map[string]interface{}{"exists": false})
+			return
+		}
+	} else if key == "" {
+		http.Error(w, "400 Need key or sha256", 400)
+		return
+	}
+
+	info, err := storageStat(context.Background(), key)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		writeJSON(w, 200, map[string]interface{}{"exists": false})
+		return
+	} else if err != nil {
+		log.Println("Storage error:", err)
+		http.Error(w, "Storage error", 502)
+		return
+	}
+	writeJSON(w, 200, map[string]interface{}{
+		"exists": true,
+		"key":    key,
+		"path":   "/" + conf.UploadSubDir + key,
+		"size":   info.Size,
+		"type":   info.ContentType,
+	})
+}
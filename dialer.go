@@ -0,0 +1,120 @@
+package main
+
+/*
+ * Outgoing connections to S3. On multi-homed hosts, the address family
+ * (S3Network) and the source address can be pinned, given directly or as an
+ * interface whose first address of the right family is used.
+ *
+ * Kept-alive connections would stick to the addresses the endpoint resolved
+ * to when they were opened, so idle ones are dropped every S3ConnRefresh,
+ * and when the circuit breaker opens.
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+func storageSourceAddr() (net.Addr, error) {
+	ip := net.ParseIP(conf.S3SourceAddress)
+	if conf.S3SourceAddress != "" && ip == nil {
+		return nil, fmt.Errorf("invalid S3SourceAddress %q", conf.S3SourceAddress)
+	}
+	if conf.S3Interface != "" {
+		iface, err := net.InterfaceByName(conf.S3Interface)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || ipn.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if is4 := ipn.IP.To4() != nil; (is4 && conf.S3Network != "tcp6") || (!is4 && conf.S3Network != "tcp4") {
+				ip = ipn.IP
+				break
+			}
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("no usable address on interface %s", conf.S3Interface)
+		}
+	}
+	if ip == nil {
+		return nil, nil
+	}
+	return &net.TCPAddr{IP: ip}, nil
+}
+
+// All transports to S3, for refreshConnections
+var (
+	transportsMu sync.Mutex
+	transports   []*http.Transport
+)
+
+/*
+ * minio's default transport, dialing as configured
+ */
+func baseTransport(secure bool) (*http.Transport, error) {
+	local, err := storageSourceAddr()
+	if err != nil {
+		return nil, err
+	}
+	tr, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{LocalAddr: local}
+	network := conf.S3Network
+	if network == "" {
+		network = "tcp"
+	}
+	tr.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	if embeddedSocket != "" {
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", embeddedSocket)
+		}
+	}
+	if local != nil {
+		log.Println("Connecting to S3 from", local)
+	}
+	transportsMu.Lock()
+	transports = append(transports, tr)
+	transportsMu.Unlock()
+	return tr, nil
+}
+
+/*
+ * Drops idle connections to S3, so the next requests resolve the endpoint
+ * again instead of sticking to addresses the provider may have retired.
+ * Connections in use finish what they're doing.
+ */
+func closeIdleStorageConnections() {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	for _, tr := range transports {
+		tr.CloseIdleConnections()
+	}
+}
+
+func refreshConnections() {
+	if conf.S3ConnRefresh <= 0 {
+		return
+	}
+	for range time.Tick(conf.S3ConnRefresh) {
+		closeIdleStorageConnections()
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+/*
+ * RFC 9530 digests, so clients can verify downloads end to end (through
+ * CDNs, caches and proxies): proxied downloads carry Repr-Digest with the
+ * SHA-256 of the file when MetadataDB has it. Clients asking for it with
+ * Want-Repr-Digest (or the older RFC 3230 Want-Digest, answered with
+ * Digest) get it either way, at the cost of reading the file an extra time
+ * when we don't know it yet. Redirected downloads are answered by S3.
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+func wantsDigest(r *http.Request) bool {
+	return strings.Contains(strings.ToLower(r.Header.Get("Want-Repr-Digest")+r.Header.Get("Want-Digest")), "sha-256")
+}
+
+/*
+ * The SHA-256 a client declared for its upload, base64, from Content-Digest
+ * or Repr-Digest (the same thing for uploads, which aren't encoded), or
+ * RFC 3230's Digest
+ */
+func declaredSHA256(h http.Header) string {
+	for _, name := range []string{"Content-Digest", "Repr-Digest", "Digest"} {
+		for _, d := range strings.Split(h.Get(name), ",") {
+			alg, value, ok := strings.Cut(strings.TrimSpace(d), "=")
+			if !ok || !strings.EqualFold(alg, "sha-256") {
+				continue
+			}
+			value = strings.Trim(value, ":")
+			if sum, err := base64.StdEncoding.DecodeString(value); err == nil && len(sum) == sha256.Size {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+func addDigestHeaders(w http.ResponseWriter, r *http.Request, key string, info minio.ObjectInfo) {
+	if isStoredCompressed(info) && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		// Sent gzipped, which is a different representation
+		return
+	}
+	m, _ := lookupFileMetadata(key)
+	if m.Hashes["sha-256"] == "" || m.Size != plainSize(info) {
+		if !wantsDigest(r) {
+			return
+		}
+		var err error
+		if m, err = computeFileMetadata(context.Background(), key, info); err != nil {
+			log.Println("Failed to compute digest:", err)
+			return
+		}
+	}
+	sum := m.Hashes["sha-256"]
+	w.Header().Set("Repr-Digest", "sha-256=:"+sum+":")
+	if strings.Contains(strings.ToLower(r.Header.Get("Want-Digest")), "sha-256") {
+		w.Header().Set("Digest", "sha-256="+sum)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+/*
+ * prosody-filer -doctor [-prosody-config /etc/prosody/prosody.cfg.lua]
+ * Checks for the usual misconfigurations and says how to fix them.
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type doctorCheck struct {
+	name string
+	run  func() (problem, hint string)
+}
+
+var prosodyOption = regexp.MustCompile(`(?m)^\s*(http_upload_external_secret|http_upload_external_base_url)\s*=\s*["']([^"']*)["']`)
+
+/*
+ * Reads the external upload settings from a Prosody config (snippet)
+ */
+func readProsodyConfig(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	opts := make(map[string]string)
+	for _, m := range prosodyOption.FindAllStringSubmatch(string(data), -1) {
+		opts[m[1]] = m[2]
+	}
+	return opts, nil
+}
+
+func s3EndpointURL() string {
+	if conf.S3TLS {
+		return "https://" + conf.S3Endpoint
+	}
+	return "http://" + conf.S3Endpoint
+}
+
+func doctorChecks(prosodyConfig string) []doctorCheck {
+	checks := []doctorCheck{
+		{"UploadSubDir", func() (string, string) {
+			if strings.HasPrefix(conf.UploadSubDir, "/") {
+				return "starts with a slash", fmt.Sprintf("use UploadSubDir = %q", strings.TrimLeft(conf.UploadSubDir, "/"))
+			}
+			if conf.UploadSubDir != "" && !strings.HasSuffix(conf.UploadSubDir, "/") {
+				return "doesn't end with a slash", fmt.Sprintf("use UploadSubDir = %q", conf.UploadSubDir+"/")
+			}
+			return "", ""
+		}},
+		{"Secret", func() (string, string) {
+			if conf.Secret == "" {
+				return "not set", "set Secret to the http_upload_external_secret from your Prosody config"
+			}
+			return "", ""
+		}},
+	}
+	if prosodyConfig != "" {
+		checks = append(checks, doctorCheck{"Prosody config", func() (string, string) {
+			opts, err := readProsodyConfig(prosodyConfig)
+			if err != nil {
+				return err.Error(), "pass the Prosody config file (or a snippet of it) with -prosody-config"
+			}
+			secret, ok := opts["http_upload_external_secret"]
+			if !ok {
+				return "no http_upload_external_secret found", "is mod_http_upload_external configured there?"
+			}
+			if secret != conf.Secret {
+				return "http_upload_external_secret doesn't match Secret", "uploads will fail with 403 until they're the same"
+			}
+			if base := opts["http_upload_external_base_url"]; base != "" {
+				u, err := url.Parse(base)
+				if err != nil {
+					return "can't parse http_upload_external_base_url: " + err.Error(), ""
+				}
+				if !strings.HasSuffix(u.Path, "/"+conf.UploadSubDir) {
+					return fmt.Sprintf("http_upload_external_base_url path %q doesn't end in /%s", u.Path, conf.UploadSubDir), "make UploadSubDir match the end of the base URL, with a trailing slash"
+				}
+			}
+			return "", ""
+		}})
+	}
+	if conf.StorageType == "local" {
+		return append(checks, doctorCheck{"StorageRoot", func() (string, string) {
+			f, err := ioutil.TempFile(conf.StorageRoot, ".incoming-")
+			if err != nil {
+				return err.Error(), "create StorageRoot and make it writable for the user the Filer runs as"
+			}
+			f.Close()
+			os.Remove(f.Name())
+			return "", ""
+		}})
+	}
+	if conf.EmbeddedStorage != "" {
+		return checks
+	}
+	if conf.S3TLS {
+		checks = append(checks, doctorCheck{"S3 TLS", func() (string, string) {
+			addr := conf.S3Endpoint
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, "443")
+			}
+			c, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, nil)
+			if err != nil {
+				return err.Error(), "check S3Endpoint is the bare host name (no https://), and that the system CA certificates are installed; S3TLS = false if it really only does plain HTTP"
+			}
+			defer c.Close()
+			cert := c.ConnectionState().PeerCertificates[0]
+			if left := time.Until(cert.NotAfter); left < 7*24*time.Hour {
+				return fmt.Sprintf("certificate expires in %s", left.Round(time.Hour)), "tell whoever runs the S3 endpoint"
+			}
+			return "", ""
+		}})
+	}
+	checks = append(checks,
+		doctorCheck{"Clock", func() (string, string) {
+			resp, err := (&http.Client{Timeout: 10 * time.Second}).Head(s3EndpointURL())
+			if err != nil {
+				return err.Error(), "can't reach S3Endpoint"
+			}
+			resp.Body.Close()
+			remote, err := http.ParseTime(resp.Header.Get("Date"))
+			if err != nil {
+				return "", ""
+			}
+			if skew := time.Since(remote); skew > 5*time.Minute || skew < -5*time.Minute {
+				return fmt.Sprintf("off by %s from S3", skew.Round(time.Second)), "S3 rejects signatures more than 15 minutes off; run NTP or systemd-timesyncd"
+			}
+			return "", ""
+		}},
+		doctorCheck{"Bucket", func() (string, string) {
+			// Don't follow redirects, they tell us about the bucket's region
+			client := &http.Client{
+				Timeout:       10 * time.Second,
+				CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			}
+			resp, err := client.Head(s3EndpointURL() + "/" + conf.S3Bucket)
+			if err != nil {
+				return err.Error(), "can't reach S3Endpoint"
+			}
+			resp.Body.Close()
+			if region := resp.Header.Get("X-Amz-Bucket-Region"); resp.StatusCode == 301 || resp.StatusCode == 307 {
+				return fmt.Sprintf("S3 redirects to region %q", region), "use the endpoint of the bucket's region as S3Endpoint, e.g. s3." + region + ".amazonaws.com"
+			}
+
+			s3Login()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if exists, err := s3Client.BucketExists(ctx, conf.S3Bucket); err != nil {
+				return err.Error(), "check S3AccessKey and S3Secret"
+			} else if !exists {
+				return "bucket " + conf.S3Bucket + " doesn't seem to exist", "create it, or fix S3Bucket (some providers always report this, then ignore it)"
+			}
+			return "", ""
+		}},
+	)
+	return checks
+}
+
+/*
+ * Runs all checks, prints the results and returns whether all were fine
+ */
+func runDoctor(prosodyConfig string) bool {
+	ok := true
+	for _, c := range doctorChecks(prosodyConfig) {
+		problem, hint := c.run()
+		if problem == "" {
+			fmt.Printf("%-16s ok\n", c.name)
+			continue
+		}
+		ok = false
+		fmt.Printf("%-16s PROBLEM: %s\n", c.name, problem)
+		if hint != "" {
+			fmt.Printf("%-16s -> %s\n", "", hint)
+		}
+	}
+	return ok
+}
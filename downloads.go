@@ -0,0 +1,168 @@
+package main
+
+/*
+ * Download counts and last access times per file, in MetadataDB, for
+ * retention policies ("never downloaded in 30 days") and for seeing how far
+ * something spread when investigating abuse. Counted in memory and written
+ * out every DownloadFlushInterval, so downloads don't each cost a write.
+ */
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const downloadBucket = "downloads"
+
+type downloadRecord struct {
+	Count      int64     `json:"count"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+func (d *downloadRecord) add(o downloadRecord) {
+	d.Count += o.Count
+	if o.LastAccess.After(d.LastAccess) {
+		d.LastAccess = o.LastAccess
+	}
+}
+
+var (
+	downloadsMu      sync.Mutex
+	pendingDownloads = make(map[string]downloadRecord)
+)
+
+/*
+ * Whether a GET fetches the file from the start, so resumed and seeking
+ * range requests aren't counted as downloads of their own
+ */
+func isWholeDownload(r *http.Request) bool {
+	rng := r.Header.Get("Range")
+	return r.Method == "GET" && (rng == "" || strings.HasPrefix(rng, "bytes=0-"))
+}
+
+func countDownload(key string, now time.Time) {
+	if !conf.DownloadTracking {
+		return
+	}
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+	d := pendingDownloads[key]
+	d.add(downloadRecord{1, now})
+	pendingDownloads[key] = d
+}
+
+func flushDownloads() {
+	if metaDB == nil {
+		return
+	}
+	downloadsMu.Lock()
+	pending := pendingDownloads
+	pendingDownloads = make(map[string]downloadRecord)
+	downloadsMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		for key, p := range pending {
+			var d downloadRecord
+			metaGet(tx, downloadBucket, key, &d)
+			d.add(p)
+			if err := metaPut(tx, downloadBucket, key, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Failed to record downloads:", err)
+		// Try again next time
+		downloadsMu.Lock()
+		for key, p := range pending {
+			d := pendingDownloads[key]
+			d.add(p)
+			pendingDownloads[key] = d
+		}
+		downloadsMu.Unlock()
+	}
+}
+
+func runDownloadFlusher() {
+	for range time.Tick(conf.DownloadFlushInterval) {
+		flushDownloads()
+	}
+}
+
+/*
+ * Downloads of key so far, including those not written out yet
+ */
+func lookupDownloads(tx *bolt.Tx, key string) downloadRecord {
+	var d downloadRecord
+	metaGet(tx, downloadBucket, key, &d)
+	downloadsMu.Lock()
+	d.add(pendingDownloads[key])
+	downloadsMu.Unlock()
+	return d
+}
+
+type downloadInfo struct {
+	Key        string     `json:"key"`
+	Size       int64      `json:"size"`
+	Uploaded   time.Time  `json:"uploaded"`
+	Downloads  int64      `json:"downloads"`
+	LastAccess *time.Time `json:"last_access,omitempty"`
+}
+
+/*
+ * GET /api/downloads?prefix=...[&unused_since=<RFC 3339>]
+ * Lists the files under prefix with their download counts, or with
+ * unused_since only those not downloaded since then (including never).
+ */
+func handleDownloads(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	if metaDB == nil || !conf.DownloadTracking {
+		http.Error(w, "501 Needs DownloadTracking and MetadataDB", 501)
+		return
+	}
+	q := r.URL.Query()
+	var since time.Time
+	if s := q.Get("unused_since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "400 Invalid unused_since", 400)
+			return
+		}
+	}
+
+	files := []downloadInfo{}
+	for obj := range storageList(r.Context(), q.Get("prefix")) {
+		if obj.Err != nil {
+			log.Println("Listing failed:", obj.Err)
+			http.Error(w, "Storage error", 502)
+			return
+		}
+		if isReservedKey(obj.Key) {
+			continue
+		}
+		var d downloadRecord
+		metaDB.View(func(tx *bolt.Tx) error {
+			d = lookupDownloads(tx, obj.Key)
+			return nil
+		})
+		if !since.IsZero() && d.LastAccess.After(since) {
+			continue
+		}
+		info := downloadInfo{Key: obj.Key, Size: obj.Size, Uploaded: obj.LastModified, Downloads: d.Count}
+		if !d.LastAccess.IsZero() {
+			info.LastAccess = &d.LastAccess
+		}
+		files = append(files, info)
+	}
+	writeJSON(w, 200, files)
+}
@@ -0,0 +1,98 @@
+package main
+
+/*
+ * Draining for rolling deploys: once draining, /ready reports not ready so
+ * load balancers stop sending new requests, while everything keeps being
+ * served as before. Either POST /api/drain and stop the process once
+ * in-flight requests reach zero, or just send SIGTERM, which drains for
+ * DrainDelay and then shuts down after the remaining requests finish.
+ */
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var drainingFlag int32
+
+// Signals (and service stop requests, on Windows) that start a shutdown
+var shutdownRequests = make(chan os.Signal, 1)
+
+func draining() bool {
+	return atomic.LoadInt32(&drainingFlag) == 1
+}
+
+func setDraining(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&drainingFlag, v) != v {
+		log.Println("Draining:", on)
+	}
+}
+
+/*
+ * POST /api/drain starts draining, DELETE /api/drain stops it again, GET
+ * reports the state and the number of requests still in flight.
+ */
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	switch r.Method {
+	case "POST":
+		setDraining(true)
+	case "DELETE":
+		setDraining(false)
+	case "GET":
+	default:
+		http.Error(w, "405 Method Not Allowed", 405)
+		return
+	}
+	writeJSON(w, 200, struct {
+		Draining bool  `json:"draining"`
+		InFlight int64 `json:"in_flight"`
+	}{draining(), atomic.LoadInt64(&statInFlight)})
+}
+
+/*
+ * Serves until SIGTERM or SIGINT, then drains and shuts down gracefully
+ */
+func serveUntilSignal(server *http.Server, lns []net.Listener) error {
+	signal.Notify(shutdownRequests, syscall.SIGTERM, os.Interrupt)
+	errc := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			if server.TLSConfig != nil {
+				// Certificates come from TLSConfig.GetCertificate
+				errc <- server.ServeTLS(ln, "", "")
+			} else {
+				errc <- server.Serve(ln)
+			}
+		}(ln)
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-shutdownRequests:
+		log.Printf("Got %s, draining for %s", sig, conf.DrainDelay)
+		setDraining(true)
+		time.Sleep(conf.DrainDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+	log.Println("All requests finished, exiting.")
+	return nil
+}
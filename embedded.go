@@ -0,0 +1,76 @@
+package main
+
+/*
+ * Embedded storage for tiny deployments: an S3-compatible object store
+ * (gofakes3) over a local directory, used through the normal S3 code paths,
+ * so one binary is all you need. Each bucket is a subdirectory of
+ * EmbeddedStorage. The store doesn't check credentials, so it's served on a
+ * Unix domain socket in there that only our user can connect to, not on a
+ * port anyone on the machine could reach.
+ */
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3afero"
+	"github.com/spf13/afero"
+)
+
+// Where the embedded store listens, if it's used
+var embeddedSocket string
+
+func startEmbeddedStorage() error {
+	if conf.EmbeddedStorage == "" {
+		return nil
+	}
+	if err := os.MkdirAll(conf.EmbeddedStorage, 0750); err != nil {
+		return err
+	}
+	store, err := s3afero.MultiBucket(afero.NewBasePathFs(afero.NewOsFs(), conf.EmbeddedStorage))
+	if err != nil {
+		return err
+	}
+	if exists, _ := store.BucketExists(conf.S3Bucket); !exists {
+		if err := store.CreateBucket(conf.S3Bucket); err != nil {
+			return err
+		}
+	}
+
+	// Next to the store's own buckets/ and metadata/
+	dir := filepath.Join(conf.EmbeddedStorage, ".socket")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+	socket := filepath.Join(dir, "s3.sock")
+	os.Remove(socket)
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		ln.Close()
+		return err
+	}
+	go func() {
+		log.Fatalln(http.Serve(ln, gofakes3.New(store).Server()))
+	}()
+
+	embeddedSocket = socket
+	// Only for the Host header, connections go to the socket
+	conf.S3Endpoint = "localhost"
+	conf.S3TLS = false
+	// Not checked, but the client wants something
+	if conf.S3AccessKey == "" {
+		conf.S3AccessKey, conf.S3Secret = "embedded", "embedded"
+	}
+	log.Printf("Embedded storage in %s serving on %s", conf.EmbeddedStorage, socket)
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+/*
+ * Application-level encryption at rest (EncryptionKey or
+ * EncryptionKeyCommand). Object bodies are
+ * encrypted with AES-256-GCM in chunks so we can stream in both directions:
+ *
+ *   "PFE1" | 8 byte random nonce prefix | chunk 0 | chunk 1 | ... | final chunk
+ *
+ * Each chunk holds encChunkSize bytes of plaintext (plus the GCM tag), except
+ * the final one which is always shorter (possibly empty). The nonce is the
+ * prefix plus a chunk counter, and the additional data marks the final
+ * chunk, so chunks can't be reordered and truncation is detected.
+ *
+ * S3 only ever sees ciphertext, so encrypted objects are always proxied.
+ */
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+const (
+	encMagic      = "PFE1"
+	encChunkSize  = 64 * 1024
+	encHeaderSize = len(encMagic) + 8
+	encScheme     = "aes256gcm-chunked"
+)
+
+var encryptionKey []byte
+
+var errEncrypted = errors.New("encrypted object is corrupt or truncated")
+
+/*
+ * Gets the key: the hex EncryptionKey from the config, or what
+ * EncryptionKeyCommand prints. The latter can unwrap a key kept encrypted by
+ * a KMS (envelope encryption), so the plain key never touches the disk.
+ */
+func loadEncryptionKey() error {
+	if conf.EncryptionKey == "" && conf.EncryptionKeyCommand == "" {
+		return nil
+	}
+	name, hexKey := "EncryptionKey", conf.EncryptionKey
+	if conf.EncryptionKeyCommand != "" {
+		if hexKey != "" {
+			return errors.New("Set either EncryptionKey or EncryptionKeyCommand, not both")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, conf.EncryptionKeyCommand).Output()
+		if err != nil {
+			return fmt.Errorf("EncryptionKeyCommand failed: %v", err)
+		}
+		name, hexKey = "EncryptionKeyCommand output", strings.TrimSpace(string(out))
+	}
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != 32 {
+		return errors.New(name + " must be 64 hex characters (256 bits)")
+	}
+	encryptionKey = key
+	return nil
+}
+
+func newGCM() cipher.AEAD {
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		panic(err) // key length was checked on load
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return gcm
+}
+
+func chunkNonce(prefix []byte, n uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], n)
+	return nonce
+}
+
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+/*
+ * Size of the ciphertext for a plaintext of the given size
+ */
+func encryptedSize(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	chunks := size/encChunkSize + 1
+	return int64(encHeaderSize) + size + chunks*int64(newGCM().Overhead())
+}
+
+/*
+ * Returns a reader with the encrypted contents of body. Close it when done,
+ * whether or not it was read to the end.
+ */
+func encryptBody(body io.Reader) io.ReadCloser {
+	return newPipeBody(func(w io.Writer) error {
+		return encryptTo(w, body)
+	})
+}
+
+func encryptTo(w io.Writer, body io.Reader) error {
+	gcm := newGCM()
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	if _, err := w.Write(append([]byte(encMagic), prefix...)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, encChunkSize)
+	for n := uint32(0); ; n++ {
+		l, err := io.ReadFull(body, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+		if _, err := w.Write(gcm.Seal(nil, chunkNonce(prefix, n), buf[:l], chunkAD(final))); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+/*
+ * Decrypting reader
+ */
+type decryptReader struct {
+	src    io.Reader
+	gcm    cipher.AEAD
+	prefix []byte
+	n      uint32
+	buf    []byte
+	plain  []byte
+	done   bool
+}
+
+func decryptBody(src io.Reader) io.Reader {
+	gcm := newGCM()
+	return &decryptReader{src: src, gcm: gcm, buf: make([]byte, encChunkSize+gcm.Overhead())}
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	if d.prefix == nil {
+		hdr := make([]byte, encHeaderSize)
+		if _, err := io.ReadFull(d.src, hdr); err != nil || string(hdr[:len(encMagic)]) != encMagic {
+			return errEncrypted
+		}
+		d.prefix = hdr[len(encMagic):]
+	}
+	l, err := io.ReadFull(d.src, d.buf)
+	final := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !final {
+		return err
+	}
+	plain, err := d.gcm.Open(d.buf[:0], chunkNonce(d.prefix, d.n), d.buf[:l], chunkAD(final))
+	if err != nil {
+		return errEncrypted
+	}
+	d.n++
+	d.plain = plain
+	d.done = final
+	return nil
+}
+
+func isStoredEncrypted(info minio.ObjectInfo) bool {
+	return info.Metadata.Get("X-Amz-Meta-Encryption") == encScheme
+}
+
+/*
+ * Sets up the upload options for storing encrypted, returning the body and
+ * size to pass to PutObject. size is -1 if the body was compressed already.
+ * The body needs closing as for encryptBody.
+ */
+func encryptUpload(opt *minio.PutObjectOptions, body io.Reader, size, originalSize int64) (io.ReadCloser, int64) {
+	if opt.UserMetadata == nil {
+		opt.UserMetadata = make(map[string]string)
+	}
+	opt.UserMetadata["Encryption"] = encScheme
+	opt.UserMetadata["Original-Size"] = strconv.FormatInt(originalSize, 10)
+	return encryptBody(body), encryptedSize(size)
+}
@@ -0,0 +1,71 @@
+package main
+
+/*
+ * Expiry of old uploads: with RetentionDays set, files stored longer ago
+ * than that are removed, checked at startup and hourly after. This goes by
+ * the object's modification time in the bucket, so it also covers files
+ * uploaded before it was enabled (unlike per-policy Retention).
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var expiredFiles = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "prosody_filer_expired_files_total",
+	Help: "Files removed for being older than RetentionDays.",
+})
+
+/*
+ * Keeps checking even while there's nothing to do, as RetentionDays can be
+ * set by a reload
+ */
+func runExpiry() {
+	for {
+		if days := settings().RetentionDays; days > 0 && !lifecycleManaged.Load() {
+			n, err := expireOld(context.Background(), time.Now())
+			if err != nil {
+				log.Println("Expiring old files failed:", err)
+			}
+			if n > 0 {
+				log.Println("Expired", n, "files older than", days, "days")
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+/*
+ * Removes the files last modified before RetentionDays ago, returns how many
+ */
+func expireOld(ctx context.Context, now time.Time) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	days := settings().RetentionDays
+	cutoff := now.AddDate(0, 0, -days)
+	why := fmt.Sprintf("older than %d days", days)
+	n := 0
+	for obj := range storageList(ctx, conf.RetentionPrefix) {
+		if obj.Err != nil {
+			return n, obj.Err
+		}
+		if isReservedKey(obj.Key) || !obj.LastModified.Before(cutoff) {
+			continue
+		}
+		err := removeObject(ctx, "expire", "expiry", why, obj.Key)
+		if err != nil && !isNotFound(err) {
+			return n, err
+		}
+		if err == nil {
+			expiredFiles.Inc()
+			n++
+		}
+	}
+	return n, nil
+}
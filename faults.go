@@ -0,0 +1,74 @@
+package main
+
+/*
+ * Fault injection, for trying out retries, the circuit breaker and error
+ * reporting in staging: a fraction of requests to S3 get a 503 instead of
+ * reaching it, and a fraction get delayed. Never enable this in production.
+ */
+
+import (
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var faultsInjected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "prosody_filer_injected_faults_total",
+	Help: "Faults injected into storage requests (FaultErrorRate, FaultLatencyRate).",
+}, []string{"kind"})
+
+const injectedError = `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>ServiceUnavailable</Code><Message>Injected fault</Message></Error>`
+
+type faultTransport struct {
+	base http.RoundTripper
+}
+
+func (ft faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if conf.FaultLatency > 0 && rand.Float64() < conf.FaultLatencyRate {
+		faultsInjected.WithLabelValues("latency").Inc()
+		select {
+		case <-time.After(conf.FaultLatency):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if rand.Float64() < conf.FaultErrorRate {
+		faultsInjected.WithLabelValues("error").Inc()
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return &http.Response{
+			Status:     "503 Service Unavailable",
+			StatusCode: 503,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": {"application/xml"}},
+			Body:       ioutil.NopCloser(strings.NewReader(injectedError)),
+			Request:    req,
+		}, nil
+	}
+	return ft.base.RoundTrip(req)
+}
+
+/*
+ * The transport for an S3 client
+ */
+func storageTransport(secure bool) http.RoundTripper {
+	base, err := baseTransport(secure)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if conf.FaultErrorRate <= 0 && conf.FaultLatencyRate <= 0 {
+		return base
+	}
+	log.Printf("WARNING: injecting faults into %.0f%% and delays into %.0f%% of storage requests", conf.FaultErrorRate*100, conf.FaultLatencyRate*100)
+	return faultTransport{base}
+}
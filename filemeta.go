@@ -0,0 +1,213 @@
+package main
+
+/*
+ * File metadata as XEP-0447 (stateless file sharing) needs it, in the shape
+ * of its XEP-0446 <file/> element: size, type, hash, image dimensions and a
+ * thumbnail reference. Gathered while an upload streams through, returned
+ * from the PUT if the client accepts JSON (with the URL, ETag and expiry of
+ * the URL added), and afterwards available as
+ * GET <file URL>?meta=1 (computed from the stored object if we don't have
+ * it yet, so clients never need to download the file for it).
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	bolt "go.etcd.io/bbolt"
+)
+
+const fileMetaBucket = "files"
+
+// Enough for image headers, including big EXIF blocks in JPEGs
+const sniffHeadSize = 128 << 10
+
+// Width of the thumbnail we point to (XEP-0264)
+const metaThumbnailWidth = 320
+
+type fileThumbnail struct {
+	URI    string `json:"uri"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type fileMetadata struct {
+	Name      string            `json:"name"`
+	Size      int64             `json:"size"`
+	MediaType string            `json:"media-type,omitempty"`
+	Hashes    map[string]string `json:"hashes"` // XEP-0300 algorithm: base64
+	Width     int               `json:"width,omitempty"`
+	Height    int               `json:"height,omitempty"`
+	Thumbnail *fileThumbnail    `json:"thumbnail,omitempty"`
+}
+
+/*
+ * JSON body of a successful PUT, for clients that accept it: the metadata
+ * plus what's needed to share the file without a HEAD afterwards
+ */
+type uploadReceipt struct {
+	fileMetadata
+	URL     string     `json:"url"`
+	ETag    string     `json:"etag,omitempty"`
+	SHA256  string     `json:"sha256,omitempty"`  // hex
+	Expires *time.Time `json:"expires,omitempty"` // of the URL
+}
+
+func newUploadReceipt(key string, m fileMetadata, etag string, now time.Time) uploadReceipt {
+	rc := uploadReceipt{fileMetadata: m, URL: "/" + conf.UploadSubDir + key, ETag: etag}
+	if sum, err := base64.StdEncoding.DecodeString(m.Hashes["sha-256"]); err == nil && len(sum) > 0 {
+		rc.SHA256 = hex.EncodeToString(sum)
+	}
+	if conf.SignedDownloads {
+		u := url.URL{Path: rc.URL, RawQuery: downloadQuery(key, now).Encode()}
+		rc.URL = u.String()
+		if conf.DownloadLinkValidity > 0 {
+			expires := now.Add(conf.DownloadLinkValidity).Truncate(time.Second)
+			rc.Expires = &expires
+		}
+	}
+	return rc
+}
+
+/*
+ * Hashes everything written to it and keeps the first bytes for sniffing
+ * image dimensions
+ */
+type metaSniffer struct {
+	hash hash.Hash
+	head bytes.Buffer
+}
+
+func newMetaSniffer() *metaSniffer {
+	return &metaSniffer{hash: sha256.New()}
+}
+
+func (s *metaSniffer) Write(p []byte) (int, error) {
+	s.hash.Write(p)
+	if room := sniffHeadSize - s.head.Len(); room > 0 {
+		if len(p) > room {
+			s.head.Write(p[:room])
+		} else {
+			s.head.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (s *metaSniffer) sha256() string {
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+func (s *metaSniffer) metadata(fileStorePath string, size int64, ctype string) fileMetadata {
+	m := fileMetadata{
+		Name:      path.Base(fileStorePath),
+		Size:      size,
+		MediaType: ctype,
+		Hashes:    map[string]string{"sha-256": base64.StdEncoding.EncodeToString(s.hash.Sum(nil))},
+	}
+	if !strings.HasPrefix(ctype, "image/") {
+		return m
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(s.head.Bytes()))
+	if err != nil || cfg.Width == 0 {
+		return m
+	}
+	m.Width, m.Height = cfg.Width, cfg.Height
+	if conf.Thumbnails && cfg.Width*cfg.Height <= maxThumbnailSourcePixels {
+		width := metaThumbnailWidth
+		if width > conf.ThumbnailMaxWidth {
+			width = conf.ThumbnailMaxWidth
+		}
+		if width > cfg.Width {
+			width = cfg.Width
+		}
+		u := "/" + conf.UploadSubDir + fileStorePath + "?" + thumbnailQuery(fileStorePath, width).Encode()
+		m.Thumbnail = &fileThumbnail{u, width, cfg.Height * width / cfg.Width}
+	}
+	return m
+}
+
+func recordFileMetadata(key string, m fileMetadata) {
+	if metaDB == nil {
+		return
+	}
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		return metaPut(tx, fileMetaBucket, key, m)
+	})
+	if err != nil {
+		log.Println("Failed to record file metadata:", err)
+	}
+}
+
+func lookupFileMetadata(key string) (m fileMetadata, found bool) {
+	if metaDB == nil {
+		return m, false
+	}
+	metaDB.View(func(tx *bolt.Tx) error {
+		found = metaGet(tx, fileMetaBucket, key, &m)
+		return nil
+	})
+	return m, found
+}
+
+/*
+ * GET <file URL>?meta=1, authorized like a download of the file
+ */
+func serveMetadata(w http.ResponseWriter, r *http.Request, fileStorePath string) {
+	info, err := storageStat(context.Background(), fileStorePath)
+	if class := storageErrorClass(err); class == "not_found" {
+		httpError(w, class, "404 Not Found", 404)
+		return
+	} else if err != nil {
+		log.Println("Storage error:", err)
+		httpError(w, class, "Storage error", 502)
+		return
+	}
+	size := plainSize(info)
+
+	m, _ := lookupFileMetadata(fileStorePath)
+	if m.Hashes == nil || m.Size != size {
+		// Don't know it (or it's stale), go through the object once
+		if m, err = computeFileMetadata(context.Background(), fileStorePath, info); err != nil {
+			log.Println("Failed to read object for metadata:", err)
+			httpError(w, storageErrorClass(err), "Storage error", 502)
+			return
+		}
+	}
+	writeJSON(w, 200, m)
+}
+
+/*
+ * Works out the metadata of a stored file by reading it, and records it
+ */
+func computeFileMetadata(ctx context.Context, key string, info minio.ObjectInfo) (fileMetadata, error) {
+	obj, err := storageGet(ctx, key)
+	if err != nil {
+		return fileMetadata{}, err
+	}
+	defer obj.Close()
+	body, err := plainReader(obj, info)
+	sniff := newMetaSniffer()
+	if err == nil {
+		_, err = io.Copy(sniff, body)
+	}
+	if err != nil {
+		return fileMetadata{}, err
+	}
+	m := sniff.metadata(key, plainSize(info), info.ContentType)
+	recordFileMetadata(key, m)
+	return m, nil
+}
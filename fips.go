@@ -0,0 +1,46 @@
+package main
+
+/*
+ * FIPS 140-3 mode, for deployments that must only use validated crypto.
+ * This uses Go's own validated module: build with GOFIPS140=v1.0.0 (see
+ * build.sh) or run with GODEBUG=fips140=on. crypto/tls then sticks to
+ * approved versions and ciphers for the S3 connection; here we check that
+ * the mode is really on and that our own use of HMAC is approved too.
+ */
+
+import (
+	"crypto/fips140"
+	"fmt"
+	"log"
+)
+
+// Shorter HMAC keys aren't allowed in FIPS mode (112 bits)
+const fipsMinKeyLength = 14
+
+func checkFIPS() error {
+	if fips140.Enabled() {
+		log.Println("Running in FIPS 140-3 mode")
+	}
+	if !conf.RequireFIPS {
+		return nil
+	}
+	if !fips140.Enabled() {
+		return fmt.Errorf("RequireFIPS is set but FIPS 140-3 mode is off (build with GOFIPS140=v1.0.0 or set GODEBUG=fips140=on)")
+	}
+	if conf.SecureLinkMD5 != "" {
+		return fmt.Errorf("SecureLinkMD5 uses MD5, which is not FIPS approved")
+	}
+	keys := []macKey{{"current", conf.Scheme, conf.Secret}}
+	if conf.PreviousSecret != "" {
+		keys = append(keys, macKey{"previous", conf.PreviousScheme, conf.PreviousSecret})
+	}
+	for _, k := range keys {
+		if !macSchemes[k.scheme].fips {
+			return fmt.Errorf("signature scheme %s is not FIPS approved", k.scheme)
+		}
+		if len(k.secret) < fipsMinKeyLength {
+			return fmt.Errorf("%s secret must be at least %d bytes in FIPS mode", k.name, fipsMinKeyLength)
+		}
+	}
+	return nil
+}
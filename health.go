@@ -0,0 +1,180 @@
+package main
+
+/*
+ * Backend health: a background prober Stats a sentinel key every
+ * HealthCheckInterval, and storage errors are counted as they happen. Both
+ * feed a circuit breaker: while it's open we answer 503 straight away
+ * instead of letting every request wait for the backend to time out, and
+ * /ready reports not ready so load balancers can route around us.
+ */
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Set while we couldn't reach the backend at all since startup
+var storageUnavailable atomic.Bool
+
+var (
+	breakerMu        sync.Mutex
+	breakerFailures  int
+	breakerOpenUntil time.Time
+)
+
+var (
+	storageUp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "prosody_filer_storage_up",
+		Help: "Whether the last health probe of the storage backend succeeded.",
+	})
+	breakerOpenGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "prosody_filer_circuit_breaker_open",
+		Help: "Whether the storage circuit breaker is currently open.",
+	})
+)
+
+/*
+ * Records the outcome of a storage call (or probe)
+ */
+func breakerRecord(ok bool) {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	if ok {
+		breakerFailures = 0
+		breakerOpenUntil = time.Time{}
+		return
+	}
+	breakerFailures++
+	if conf.BreakerThreshold > 0 && breakerFailures >= conf.BreakerThreshold {
+		if breakerOpenUntil.IsZero() {
+			log.Printf("Storage failing (%d errors in a row), opening circuit breaker", breakerFailures)
+			// Maybe the endpoint moved
+			go closeIdleStorageConnections()
+		}
+		breakerOpenUntil = time.Now().Add(conf.BreakerCooldown)
+	}
+}
+
+func breakerOpen() bool {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	open := time.Now().Before(breakerOpenUntil)
+	if open {
+		breakerOpenGauge.Set(1)
+	} else {
+		breakerOpenGauge.Set(0)
+	}
+	return open
+}
+
+func storageDown() bool {
+	return storageUnavailable.Load() || breakerOpen()
+}
+
+// First wait before retryStorage tries again, doubling each time
+var storageRetryDelay = time.Second
+
+/*
+ * Retries connecting to the backend after a failed start, with exponential
+ * backoff up to a minute
+ */
+func retryStorage() {
+	delay := storageRetryDelay
+	for {
+		time.Sleep(delay)
+		err := checkBucket()
+		if err == nil {
+			log.Println("Storage available again")
+			storageUnavailable.Store(false)
+			return
+		}
+		log.Println("Storage still unavailable:", err)
+		if delay *= 2; delay > time.Minute {
+			delay = time.Minute
+		}
+	}
+}
+
+/*
+ * Whether an error means the backend is in trouble, as opposed to e.g. a
+ * missing object or a client that went away mid-upload. Only answers from
+ * S3 and failures of the round trip to it count.
+ */
+func isBackendFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, errLengthMismatch) {
+		return false
+	}
+	if errors.As(err, new(clientReadError)) || errors.As(err, new(*http.MaxBytesError)) {
+		return false
+	}
+	if storageErrorClass(err) == "s3_timeout" {
+		return true
+	}
+	if status := minio.ToErrorResponse(err).StatusCode; status != 0 {
+		return status >= 500
+	}
+	// No status: only if we never got an answer
+	var ne net.Error
+	var ue *url.Error
+	return errors.As(err, &ne) || errors.As(err, &ue)
+}
+
+func probeStorage() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := storageStat(ctx, conf.HealthCheckKey)
+	// Not finding the sentinel is fine, the backend answered
+	ok := err == nil || minio.ToErrorResponse(err).Code == "NoSuchKey"
+	if !ok {
+		log.Println("Storage health probe failed:", err)
+		storageUp.Set(0)
+	} else {
+		storageUp.Set(1)
+	}
+	return ok
+}
+
+func runHealthProber() {
+	if conf.HealthCheckInterval <= 0 {
+		return
+	}
+	for {
+		probeStorage()
+		time.Sleep(conf.HealthCheckInterval)
+	}
+}
+
+/*
+ * Answers 503 with Retry-After if the breaker is open. Returns false if
+ * the request should not go on.
+ */
+func checkBreaker(w http.ResponseWriter) bool {
+	if !storageDown() {
+		return true
+	}
+	shedLoad(w, "breaker_open", "storage_down", "Storage unavailable", conf.BreakerCooldown)
+	return false
+}
+
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if draining() {
+		http.Error(w, "not ready: draining", 503)
+		return
+	}
+	if storageDown() {
+		http.Error(w, "not ready: storage unavailable", 503)
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,103 @@
+package main
+
+/*
+ * Operator hooks: executables run on upload lifecycle events, for custom
+ * scanning, indexing or notifications. They get the event as FILER_*
+ * environment variables and as a JSON object on stdin.
+ *
+ *  - HookPreAccept runs before an upload's body is read; a non-zero exit
+ *    rejects the upload (with the first line of its output as the reason)
+ *  - HookPostUpload runs after a file was stored
+ *  - HookPostDelete runs after a file was removed through the admin API
+ *
+ * Post hooks run in the background, and failures are only logged. All
+ * hooks are killed after HookTimeout.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var hookRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "prosody_filer_hook_runs_total",
+	Help: "Hook executions by event and result (ok, rejected, error).",
+}, []string{"event", "result"})
+
+type hookEvent map[string]string
+
+/*
+ * Runs the hook for an event. A non-nil *exec.ExitError means the hook ran
+ * and said no.
+ */
+func runHook(hook, event string, ev hookEvent) (output string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.HookTimeout)
+	defer cancel()
+	ev["event"] = event
+	input, _ := json.Marshal(ev)
+
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Env = os.Environ()
+	for k, v := range ev {
+		cmd.Env = append(cmd.Env, "FILER_"+strings.ToUpper(k)+"="+v)
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	out, err := cmd.Output()
+	if line, _, _ := bufio.NewReader(bytes.NewReader(out)).ReadLine(); len(line) > 0 {
+		output = string(line)
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		hookRuns.WithLabelValues(event, "ok").Inc()
+	case errors.As(err, &exitErr) && ctx.Err() == nil:
+		hookRuns.WithLabelValues(event, "rejected").Inc()
+	default:
+		hookRuns.WithLabelValues(event, "error").Inc()
+	}
+	return output, err
+}
+
+/*
+ * Asks HookPreAccept about an upload. Returns nil if it may go ahead.
+ */
+func preAcceptHook(ev hookEvent) *uploadRejection {
+	if conf.HookPreAccept == "" {
+		return nil
+	}
+	output, err := runHook(conf.HookPreAccept, "pre-accept", ev)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if output == "" {
+			output = "Rejected by policy"
+		}
+		return &uploadRejection{403, "hook_rejected", output}
+	} else if err != nil {
+		// Fail closed, the hook may be a malware scanner
+		log.Println("Pre-accept hook failed:", err)
+		return &uploadRejection{503, "hook_error", "Upload checks unavailable"}
+	}
+	return nil
+}
+
+func postHook(hook, event string, ev hookEvent) {
+	if hook == "" {
+		return
+	}
+	go func() {
+		if output, err := runHook(hook, event, ev); err != nil {
+			log.Printf("%s hook failed: %v %s", event, err, output)
+		}
+	}()
+}
@@ -0,0 +1,176 @@
+package main
+
+/*
+ * Client retries: when a PUT timed out on the client's side but actually
+ * went through, the retry finds the object already stored. If it has the
+ * declared size, and the hash of what's sent now matches if we recorded
+ * one, we answer 201 as if we stored it again, without writing to S3 (and
+ * without reading the body at all if there's no hash to compare against).
+ * A different file of the same size gets 409 instead of overwriting.
+ *
+ * Clients that re-share the same file over and over can skip sending it
+ * altogether, see handleIdenticalUpload.
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var retriedUploads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "prosody_filer_retried_uploads_total",
+	Help: "PUTs of files that were already stored, by outcome.",
+}, []string{"result"})
+
+/*
+ * Returns true if the upload was already stored and the request has been
+ * answered. Uploads with a password are always stored again, so that it's
+ * set.
+ */
+func handleRetriedUpload(w http.ResponseWriter, r *http.Request, key string, declared int64, password string) bool {
+	if !conf.IdempotentUploads || r.ContentLength != declared || password != "" {
+		return false
+	}
+	info, err := storageStat(context.Background(), key)
+	if err != nil || plainSize(info) != declared {
+		// Not there, or not this upload, so just store it
+		return false
+	}
+
+	m, known := lookupFileMetadata(key)
+	if sum := m.Hashes["sha-256"]; known && m.Size == declared && sum != "" {
+		exact := &exactReader{r: r.Body, remaining: r.ContentLength}
+		h := sha256.New()
+		if _, err := io.Copy(h, exact); err != nil {
+			log.Println("Reading retried upload failed:", err)
+			httpError(w, "length_mismatch", "400 Body doesn't match Content-Length", 400)
+			return true
+		}
+		if base64.StdEncoding.EncodeToString(h.Sum(nil)) != sum {
+			log.Println("Different file uploaded to existing", key)
+			retriedUploads.WithLabelValues("conflict").Inc()
+			httpError(w, "conflict", "409 Conflict", 409)
+			return true
+		}
+	}
+
+	log.Println("Upload of", key, "already stored, not storing it again")
+	retriedUploads.WithLabelValues("stored").Inc()
+	answerStored(w, r, key, info.ETag, m, known)
+	return true
+}
+
+/*
+ * With SkipIdenticalUploads, a client declaring the SHA-256 of its upload
+ * (Content-Digest) doesn't need to send it if we have it: if the file at
+ * the key is that already, or if another file of the same user is (by the
+ * hashes recorded in MetadataDB), which is then copied within the bucket.
+ * Knowing a hash doesn't prove having the file, so files of other users,
+ * and ones protected by a password or encryption, are never copied. Returns
+ * true if the request has been answered.
+ */
+func handleIdenticalUpload(w http.ResponseWriter, r *http.Request, key string, declared int64, pol effectivePolicy, password string) bool {
+	if !conf.SkipIdenticalUploads || metaDB == nil || password != "" {
+		return false
+	}
+	sum := declaredSHA256(r.Header)
+	if sum == "" {
+		return false
+	}
+	ctx := context.Background()
+	if m, known := lookupFileMetadata(key); known && m.Size == declared && m.Hashes["sha-256"] == sum {
+		if info, err := storageStat(ctx, key); err == nil && plainSize(info) == declared {
+			log.Println("Upload of", key, "already stored, not storing it again")
+			retriedUploads.WithLabelValues("identical").Inc()
+			answerStored(w, r, key, info.ETag, m, true)
+			return true
+		}
+	}
+
+	raw, _ := base64.StdEncoding.DecodeString(sum)
+	src, found := lookupHash(hex.EncodeToString(raw))
+	if !found || src == key || userOf(src) != userOf(key) {
+		return false
+	}
+	if _, protected := lookupFilePassword(src); protected {
+		return false
+	}
+	m, known := lookupFileMetadata(src)
+	info, err := storageStat(ctx, src)
+	if !known || m.Hashes["sha-256"] != sum || err != nil || plainSize(info) != declared || isStoredEncrypted(info) {
+		return false
+	}
+	etag, err := copyStored(ctx, src, key, info)
+	if err != nil {
+		// Not fatal, the client can still send it
+		log.Println("Copying identical upload failed:", err)
+		return false
+	}
+	log.Printf("Upload of %s is identical to %s, copied it", key, src)
+	retriedUploads.WithLabelValues("copied").Inc()
+	ch := make(http.Header)
+	addContentHeaders(ch, key)
+	m.Name = path.Base(key)
+	m.MediaType = ch.Get("Content-Type")
+	clearTombstone(key)
+	recordRetention(key, pol, time.Now())
+	recordUsage(key, declared)
+	recordFileMetadata(key, m)
+	dualWrite(ctx, key)
+	cdnPrefetch(key)
+	answerStored(w, r, key, etag, m, true)
+	return true
+}
+
+/*
+ * Server-side copy of a stored file, keeping how it's stored (compression,
+ * encryption) but with content headers for its new name
+ */
+func copyStored(ctx context.Context, src, dst string, info minio.ObjectInfo) (string, error) {
+	meta := make(map[string]string)
+	for k, v := range info.UserMetadata {
+		meta["X-Amz-Meta-"+k] = v
+	}
+	ch := make(http.Header)
+	addContentHeaders(ch, dst)
+	meta["Content-Type"] = ch.Get("Content-Type")
+	meta["Content-Disposition"] = ch.Get("Content-Disposition")
+	if enc := info.Metadata.Get("Content-Encoding"); enc != "" {
+		meta["Content-Encoding"] = enc
+	}
+	up, err := storageCopy(ctx,
+		minio.CopyDestOptions{Bucket: conf.S3Bucket, Object: dst, UserMetadata: meta, ReplaceMetadata: true},
+		minio.CopySrcOptions{Bucket: conf.S3Bucket, Object: src})
+	return up.ETag, err
+}
+
+/*
+ * Answers a PUT of a file we already have as if it had just been stored
+ */
+func answerStored(w http.ResponseWriter, r *http.Request, key, etag string, m fileMetadata, known bool) {
+	if conf.SignedDownloads {
+		w.Header().Set("Location", tenantURL(r, signedDownloadURL(key)))
+	}
+	if etag != "" {
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+	if known && strings.Contains(r.Header.Get("Accept"), "application/json") {
+		receipt := newUploadReceipt(key, m, etag, time.Now())
+		receipt.URL = tenantURL(r, receipt.URL)
+		writeJSON(w, http.StatusCreated, receipt)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,221 @@
+//go:build integration
+
+package main
+
+/*
+ * End to end tests against a real MinIO in a container, covering what the
+ * in-process fake doesn't: presigned redirects followed by a real HTTP
+ * client, multipart uploads and composing chunks. Needs Docker; run with
+ * go test -tags integration ./...
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	tcminio "github.com/testcontainers/testcontainers-go/modules/minio"
+)
+
+func setupMinio(t *testing.T) *httptest.Server {
+	ctx := context.Background()
+	container, err := tcminio.Run(ctx, "minio/minio:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { container.Terminate(ctx) })
+	endpoint, err := container.ConnectionString(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setConfigDefaults(&conf)
+	conf.Secret = "integration secret"
+	conf.UploadSubDir = "upload/"
+	conf.S3Endpoint = endpoint
+	conf.S3TLS = false
+	conf.S3AccessKey = container.Username
+	conf.S3Secret = container.Password
+	conf.S3Bucket = "prosody-filer"
+	s3Login()
+	if err := s3Client.MakeBucket(ctx, conf.S3Bucket, minio.MakeBucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+conf.UploadSubDir, handleRequest)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func signedUploadURL(srv *httptest.Server, fileStorePath string, size int64) string {
+	q := url.Values{"v": {macSchemes[conf.Scheme].sign(conf.Secret, fileStorePath, size, "")}}
+	return srv.URL + "/" + conf.UploadSubDir + fileStorePath + "?" + q.Encode()
+}
+
+func download(t *testing.T, srv *httptest.Server, fileStorePath string) []byte {
+	// Follows the redirect to S3 unless in ProxyMode
+	resp, err := http.Get(srv.URL + "/" + conf.UploadSubDir + fileStorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET %s: %s", fileStorePath, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection lost")
+}
+
+func TestIntegration(t *testing.T) {
+	srv := setupMinio(t)
+	catmetalfile, err := ioutil.ReadFile("catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("upload", func(t *testing.T) {
+		req, _ := http.NewRequest("PUT", signedUploadURL(srv, "thomas/abc/catmetal.jpg", int64(len(catmetalfile))), bytes.NewReader(catmetalfile))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 201 {
+			t.Fatalf("upload: %s", resp.Status)
+		}
+	})
+
+	for _, proxy := range []bool{false, true} {
+		t.Run(fmt.Sprintf("download proxy %t", proxy), func(t *testing.T) {
+			conf.ProxyMode = proxy
+			defer func() { conf.ProxyMode = false }()
+			if got := download(t, srv, "thomas/abc/catmetal.jpg"); !bytes.Equal(got, catmetalfile) {
+				t.Errorf("downloaded %d bytes, want the %d uploaded", len(got), len(catmetalfile))
+			}
+		})
+	}
+
+	t.Run("resumed multipart upload", func(t *testing.T) {
+		conf.ResumableUploads = true
+		conf.PartSize = 5 << 20
+		defer func() { conf.ResumableUploads, conf.PartSize = false, 16<<20 }()
+
+		data := make([]byte, 12<<20)
+		rand.Read(data)
+		size := int64(len(data))
+		signed := signedUploadURL(srv, "thomas/abc/big.bin", size)
+
+		// Connection drops after 6 MiB, so one part gets committed
+		req, _ := http.NewRequest("PUT", signed, io.MultiReader(bytes.NewReader(data[:6<<20]), failingReader{}))
+		req.ContentLength = size
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			t.Fatalf("interrupted upload succeeded: %s", resp.Status)
+		}
+
+		var offset int64
+		for i := 0; i < 50 && offset == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+			req, _ = http.NewRequest("HEAD", signed, nil)
+			req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			offset, _ = strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+		}
+		if offset != conf.PartSize {
+			t.Fatalf("Upload-Offset %d after interruption, want %d", offset, conf.PartSize)
+		}
+
+		req, _ = http.NewRequest("PUT", signed, bytes.NewReader(data[offset:]))
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 201 {
+			t.Fatalf("resumed upload: %s", resp.Status)
+		}
+		if got := download(t, srv, "thomas/abc/big.bin"); !bytes.Equal(got, data) {
+			t.Errorf("resumed upload came back different (%d bytes)", len(got))
+		}
+	})
+
+	t.Run("chunked upload", func(t *testing.T) {
+		conf.ChunkedUploads = true
+		conf.MetadataDB = filepath.Join(t.TempDir(), "meta.db")
+		openMetadataDB()
+		defer func() {
+			conf.ChunkedUploads = false
+			metaDB.Close()
+			metaDB = nil
+		}()
+
+		data := make([]byte, 5<<20+3)
+		rand.Read(data)
+		size := int64(len(data))
+		signed := signedUploadURL(srv, "thomas/abc/chunked.bin", size)
+		send := func(method, query string, body []byte) int {
+			req, _ := http.NewRequest(method, signed+"&"+query, bytes.NewReader(body))
+			req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		if code := send("PUT", "chunk=1", data[:5<<20]); code != 201 {
+			t.Fatalf("chunk 1: %d", code)
+		}
+		if code := send("PUT", "chunk=2", data[5<<20:]); code != 201 {
+			t.Fatalf("chunk 2: %d", code)
+		}
+		if code := send("POST", "compose=2", nil); code != 201 {
+			t.Fatalf("compose: %d", code)
+		}
+		if got := download(t, srv, "thomas/abc/chunked.bin"); !bytes.Equal(got, data) {
+			t.Errorf("composed file came back different (%d bytes)", len(got))
+		}
+		for i := 1; i <= 2; i++ {
+			if _, err := storageStat(context.Background(), chunkKey("thomas/abc/chunked.bin", i)); err == nil {
+				t.Errorf("chunk %d left after composing", i)
+			}
+		}
+		sum := sha256.Sum256(data)
+		if key, _ := lookupHash(hex.EncodeToString(sum[:])); key != "thomas/abc/chunked.bin" {
+			t.Errorf("hash of composed file recorded for %q", key)
+		}
+		if m, known := lookupFileMetadata("thomas/abc/chunked.bin"); !known || m.Size != size {
+			t.Errorf("composed file has metadata %+v", m)
+		}
+	})
+}
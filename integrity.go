@@ -0,0 +1,151 @@
+package main
+
+/*
+ * Bit rot detection for long-term storage on cheap backends: every
+ * IntegrityCheckInterval, IntegrityCheckSample random files with a recorded
+ * SHA-256 (in MetadataDB) are read back and checked against it, and against
+ * their ETag where that's a plain MD5 of the stored bytes. Corruption is
+ * logged, counted in prosody_filer_integrity_checks_total and sent to the
+ * audit stream.
+ */
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	integrityChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prosody_filer_integrity_checks_total",
+		Help: "Files read back to verify their checksums, by result (ok, corrupt, missing, error).",
+	}, []string{"result"})
+	integrityLastRun = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "prosody_filer_integrity_last_run_timestamp_seconds",
+		Help: "When the last integrity check run finished.",
+	})
+)
+
+type integritySample struct {
+	key  string
+	meta fileMetadata
+}
+
+/*
+ * Picks up to n random files with a recorded hash
+ */
+func sampleFiles(n int) []integritySample {
+	var picked []integritySample
+	seen := 0
+	metaDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(fileMetaBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			// Reservoir sampling, so every file has the same chance
+			seen++
+			i := len(picked)
+			if i >= n {
+				if i = rand.Intn(seen); i >= n {
+					return nil
+				}
+			}
+			var s integritySample
+			if !metaGet(tx, fileMetaBucket, string(k), &s.meta) || s.meta.Hashes["sha-256"] == "" {
+				return nil
+			}
+			s.key = string(k)
+			if i == len(picked) {
+				picked = append(picked, s)
+			} else {
+				picked[i] = s
+			}
+			return nil
+		})
+	})
+	return picked
+}
+
+/*
+ * Reads a file back and compares it with what we recorded. Returns the
+ * result class, and what's wrong for corrupt files.
+ */
+func verifyFile(ctx context.Context, s integritySample) (result, problem string) {
+	obj, err := storageGet(ctx, s.key)
+	if storageErrorClass(err) == "not_found" {
+		return "missing", ""
+	} else if err != nil {
+		log.Println("Integrity check: reading", s.key, "failed:", err)
+		return "error", ""
+	}
+	defer obj.Close()
+	info, err := obj.Stat()
+	if err != nil {
+		return "error", ""
+	}
+
+	stored := md5.New()
+	body, err := plainReader(io.TeeReader(obj, stored), info)
+	if err != nil {
+		return "corrupt", "can't decode: " + err.Error()
+	}
+	sum := sha256.New()
+	n, err := io.Copy(sum, body)
+	if err != nil {
+		if errors.Is(err, errEncrypted) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) {
+			// The stored bytes changed
+			return "corrupt", "can't decode: " + err.Error()
+		}
+		log.Println("Integrity check: reading", s.key, "failed:", err)
+		return "error", ""
+	}
+	if n != s.meta.Size {
+		return "corrupt", "size " + strconv.FormatInt(n, 10) + ", recorded " + strconv.FormatInt(s.meta.Size, 10)
+	}
+	if base64.StdEncoding.EncodeToString(sum.Sum(nil)) != s.meta.Hashes["sha-256"] {
+		return "corrupt", "SHA-256 mismatch"
+	}
+	// Multipart ETags ("...-<parts>") aren't the MD5 of the object
+	if etag := strings.Trim(info.ETag, `"`); len(etag) == 32 && !strings.Contains(etag, "-") {
+		if hex.EncodeToString(stored.Sum(nil)) != etag {
+			return "corrupt", "ETag mismatch"
+		}
+	}
+	return "ok", ""
+}
+
+func checkIntegrity(ctx context.Context) {
+	for _, s := range sampleFiles(conf.IntegrityCheckSample) {
+		result, problem := verifyFile(ctx, s)
+		integrityChecks.WithLabelValues(result).Inc()
+		if result == "corrupt" {
+			log.Printf("Integrity check: %s is corrupt: %s", s.key, problem)
+			writeAuditEvent(formatAuditEvent("corruption", "key", s.key, "problem", problem))
+		}
+	}
+	integrityLastRun.SetToCurrentTime()
+}
+
+func runIntegrityChecks() {
+	if conf.IntegrityCheckInterval <= 0 || metaDB == nil {
+		return
+	}
+	for range time.Tick(conf.IntegrityCheckInterval) {
+		checkIntegrity(context.Background())
+	}
+}
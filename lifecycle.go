@@ -0,0 +1,76 @@
+package main
+
+/*
+ * With ManageLifecycle, retention is left to the storage provider: at
+ * startup we install a lifecycle rule on the bucket that expires objects
+ * (under RetentionPrefix) after RetentionDays, and aborts multipart uploads
+ * left incomplete for MultipartMaxAge. Other rules on the bucket are kept. Objects the provider
+ * expires don't go through the Filer, so they aren't audited, purged from a
+ * CDN or taken off quotas; if the rule can't be installed, the in-process
+ * expiry takes over.
+ */
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/lifecycle"
+)
+
+const lifecycleRuleID = "prosody-filer-retention"
+
+// Set once our rule is in place
+var lifecycleManaged atomic.Bool
+
+func manageLifecycle(ctx context.Context) error {
+	if !conf.ManageLifecycle {
+		return nil
+	}
+	config, err := storageGetLifecycle(ctx)
+	if minio.ToErrorResponse(err).Code == "NoSuchLifecycleConfiguration" {
+		config, err = lifecycle.NewConfiguration(), nil
+	}
+	if err != nil {
+		return err
+	}
+	days := settings().RetentionDays
+	if err := storageSetLifecycle(ctx, lifecycleRules(config, days)); err != nil {
+		return err
+	}
+	lifecycleManaged.Store(days > 0)
+	if days > 0 {
+		log.Printf("Installed lifecycle rule expiring files after %d days", days)
+	}
+	return nil
+}
+
+/*
+ * The bucket's rules with ours replaced, or removed if there's nothing to
+ * expire (days <= 0)
+ */
+func lifecycleRules(config *lifecycle.Configuration, days int) *lifecycle.Configuration {
+	out := lifecycle.NewConfiguration()
+	for _, r := range config.Rules {
+		if r.ID != lifecycleRuleID {
+			out.Rules = append(out.Rules, r)
+		}
+	}
+	if days <= 0 {
+		return out
+	}
+	rule := lifecycle.Rule{
+		ID:         lifecycleRuleID,
+		Status:     "Enabled",
+		RuleFilter: lifecycle.Filter{Prefix: conf.RetentionPrefix},
+		Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(days)},
+	}
+	if conf.MultipartMaxAge > 0 {
+		days := (conf.MultipartMaxAge + 24*time.Hour - 1) / (24 * time.Hour)
+		rule.AbortIncompleteMultipartUpload.DaysAfterInitiation = lifecycle.ExpirationDays(days)
+	}
+	out.Rules = append(out.Rules, rule)
+	return out
+}
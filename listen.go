@@ -0,0 +1,173 @@
+package main
+
+/*
+ * Opening the listening sockets. With ReusePort, sockets are opened with
+ * SO_REUSEPORT: another Filer process can then bind the same port (for
+ * blue/green swaps, or several processes on a many-core box), and
+ * AcceptLoops sockets are opened so the kernel spreads new connections
+ * over that many accept loops.
+ *
+ * ListenNetwork "tcp6" on [::] gives an IPv6-only socket, "tcp4" IPv4 only,
+ * and "tcp" (the default) both where the OS allows.
+ *
+ * Listenport "unix:/path" listens on a Unix domain socket instead, for a
+ * reverse proxy on the same host, with SocketMode permissions and owned by
+ * SocketGroup if set.
+ *
+ * Started by systemd with socket activation, we serve on the sockets passed
+ * to us instead (and Listenport is ignored). Those named "redirect"
+ * (FileDescriptorName= in the .socket unit) get the HTTP to HTTPS redirect,
+ * the rest the Filer itself.
+ */
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor systemd passes (SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+// Passed by systemd for the redirect, set by listen
+var redirectListeners []net.Listener
+
+func listen(address string) ([]net.Listener, error) {
+	activated, err := systemdListeners()
+	if err != nil || len(activated) > 0 {
+		var lns []net.Listener
+		for i, ln := range activated {
+			if activatedNames[i] == "redirect" {
+				redirectListeners = append(redirectListeners, ln)
+			} else {
+				lns = append(lns, ln)
+			}
+		}
+		if err == nil && len(lns) == 0 {
+			err = fmt.Errorf("no sockets for the Filer among those passed by systemd: %v", activatedNames)
+		}
+		return lns, err
+	}
+	if strings.HasPrefix(address, "unix:") {
+		ln, err := listenUnix(strings.TrimPrefix(address, "unix:"))
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+	if !conf.ReusePort {
+		ln, err := net.Listen(conf.ListenNetwork, address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+	lc := net.ListenConfig{Control: setReusePort}
+	n := conf.AcceptLoops
+	if n < 1 {
+		n = 1
+	}
+	var lns []net.Listener
+	for i := 0; i < n; i++ {
+		ln, err := lc.Listen(context.Background(), conf.ListenNetwork, address)
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	// Left behind if we didn't get to shut down cleanly
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	mode, _ := strconv.ParseUint(conf.SocketMode, 8, 32)
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if conf.SocketGroup != "" {
+		g, err := user.LookupGroup(conf.SocketGroup)
+		if err == nil {
+			gid, _ := strconv.Atoi(g.Gid)
+			err = os.Chown(path, -1, gid)
+		}
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("socket group %s: %v", conf.SocketGroup, err)
+		}
+	}
+	return ln, nil
+}
+
+// Names of the sockets from systemdListeners
+var activatedNames []string
+
+/*
+ * The sockets passed by systemd (sd_listen_fds), none if we weren't socket
+ * activated. The environment is cleared so child processes (hooks) don't
+ * think they were meant for them.
+ */
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	fds, names := os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	activatedNames = strings.Split(names, ":")
+	for len(activatedNames) < n {
+		activatedNames = append(activatedNames, "")
+	}
+	activatedNames = activatedNames[:n]
+	files := make([]*os.File, n)
+	for i, name := range activatedNames {
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), name)
+	}
+	return fileListeners(files)
+}
+
+/*
+ * Listeners on the sockets in files, which are closed
+ */
+func fileListeners(files []*os.File) ([]net.Listener, error) {
+	var lns []net.Listener
+	var err error
+	for _, f := range files {
+		var ln net.Listener
+		if err == nil {
+			ln, err = net.FileListener(f)
+			if err != nil {
+				err = fmt.Errorf("socket %d (%s) from systemd: %v", f.Fd(), f.Name(), err)
+			} else {
+				lns = append(lns, ln)
+			}
+		}
+		f.Close()
+	}
+	if err != nil {
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return nil, err
+	}
+	return lns, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+/*
+ * Local filesystem storage (StorageType = "local"), for hosts without S3:
+ * files are kept under StorageRoot at their upload path, the way the
+ * original prosody-filer did, so moving to S3 later is a matter of pointing
+ * LegacyDirectory at the old StorageRoot. Downloads are always proxied, and
+ * features that need S3 (or to store object metadata) aren't available.
+ */
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+var errNoSuchKey = minio.ErrorResponse{Code: "NoSuchKey", Message: "The specified key does not exist.", StatusCode: http.StatusNotFound}
+
+type localBackend struct {
+	root string
+}
+
+/*
+ * Features that only work with S3, checked in readConfig
+ */
+func localStorageConflicts() []string {
+	var conflicts []string
+	for _, c := range []struct {
+		on   bool
+		name string
+	}{
+		{conf.ResumableUploads, "ResumableUploads"},
+		{conf.ChunkedUploads, "ChunkedUploads"},
+		{conf.PresignedPost, "PresignedPost"},
+		{conf.CompressText, "CompressText"},
+		{conf.EncryptionKey != "" || conf.EncryptionKeyCommand != "", "EncryptionKey"},
+		{conf.DetectOMEMO, "DetectOMEMO"},
+		{conf.SkipIdenticalUploads, "SkipIdenticalUploads"},
+		{conf.LegacyS3Bucket != "", "LegacyS3Bucket"},
+		{conf.EmbeddedStorage != "", "EmbeddedStorage"},
+	} {
+		if c.on {
+			conflicts = append(conflicts, c.name)
+		}
+	}
+	return conflicts
+}
+
+func localLogin() error {
+	if err := os.MkdirAll(conf.StorageRoot, 0750); err != nil {
+		return err
+	}
+	backend = localBackend{filepath.Clean(conf.StorageRoot)}
+	log.Println("Storing files in", conf.StorageRoot)
+	return nil
+}
+
+func (b localBackend) file(key string) string {
+	return filepath.Join(b.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (b localBackend) info(key string, fi os.FileInfo) minio.ObjectInfo {
+	return minio.ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+		ContentType:  mime.TypeByExtension(filepath.Ext(key)),
+	}
+}
+
+/*
+ * Writes to a temporary file next to the target first, so readers never
+ * see half a file
+ */
+func (b localBackend) Put(ctx context.Context, key string, body io.Reader, size int64, opt minio.PutObjectOptions) (minio.UploadInfo, error) {
+	name := b.file(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0750); err != nil {
+		return minio.UploadInfo{}, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), ".incoming-")
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	defer os.Remove(f.Name())
+	h := md5.New()
+	var r io.Reader = &contextReader{ctx, body}
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && size >= 0 && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return minio.UploadInfo{}, err
+	}
+	return minio.UploadInfo{Bucket: conf.S3Bucket, Key: key, ETag: hex.EncodeToString(h.Sum(nil)), Size: n, LastModified: time.Now()}, nil
+}
+
+type localObject struct {
+	*os.File
+	info minio.ObjectInfo
+}
+
+func (o localObject) Stat() (minio.ObjectInfo, error) {
+	return o.info, nil
+}
+
+func (b localBackend) Get(ctx context.Context, key string) (StorageObject, error) {
+	f, err := os.Open(b.file(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoSuchKey
+	} else if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, errNoSuchKey
+	}
+	return localObject{f, b.info(key, fi)}, nil
+}
+
+func (b localBackend) Stat(ctx context.Context, key string) (minio.ObjectInfo, error) {
+	fi, err := os.Stat(b.file(key))
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !fi.Mode().IsRegular()) {
+		return minio.ObjectInfo{}, errNoSuchKey
+	} else if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	return b.info(key, fi), nil
+}
+
+func (b localBackend) Presign(ctx context.Context, key string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	return nil, errors.New("local storage can't presign URLs")
+}
+
+/*
+ * Also removes directories left empty, up to the root
+ */
+func (b localBackend) Remove(ctx context.Context, key string) error {
+	name := b.file(key)
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for dir := filepath.Dir(name); strings.HasPrefix(dir, b.root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (b localBackend) List(ctx context.Context, prefix string) <-chan minio.ObjectInfo {
+	out := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(out)
+		filepath.Walk(b.root, func(name string, fi os.FileInfo, err error) error {
+			if err != nil {
+				select {
+				case out <- minio.ObjectInfo{Err: err}:
+				case <-ctx.Done():
+				}
+				return err
+			}
+			if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".incoming-") {
+				return nil
+			}
+			rel, _ := filepath.Rel(b.root, name)
+			key := filepath.ToSlash(rel)
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			select {
+			case out <- b.info(key, fi):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return out
+}
+
+/*
+ * Stops a copy when the request's context is done
+ */
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
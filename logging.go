@@ -0,0 +1,89 @@
+package main
+
+/*
+ * Log noise control. Per-request informational messages go through
+ * logRequest and can be switched off with QuietLogs; errors are always
+ * logged. Events that can come in floods (a scanner hammering us with bad
+ * MACs) go through logSampled, which lets LogSampleBurst of them through per
+ * minute and then only reports how many were dropped. Passwords in file URLs
+ * are blanked out.
+ */
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+func logRequest(v ...interface{}) {
+	if !settings().QuietLogs {
+		log.Println(v...)
+	}
+}
+
+func logRequestf(format string, v ...interface{}) {
+	if !settings().QuietLogs {
+		log.Printf(format, v...)
+	}
+}
+
+type sampleWindow struct {
+	start   time.Time
+	logged  int
+	dropped int
+}
+
+var (
+	sampleMu      sync.Mutex
+	sampleWindows = make(map[string]*sampleWindow)
+)
+
+func logSampled(key string, format string, v ...interface{}) {
+	burst := settings().LogSampleBurst
+	sampleMu.Lock()
+	now := time.Now()
+	sw := sampleWindows[key]
+	if sw == nil || now.Sub(sw.start) >= time.Minute {
+		if sw != nil && sw.dropped > 0 {
+			log.Printf("(suppressed %d more %q messages)", sw.dropped, key)
+		}
+		sw = &sampleWindow{start: now}
+		sampleWindows[key] = sw
+	}
+	ok := burst <= 0 || sw.logged < burst
+	if ok {
+		sw.logged++
+	} else {
+		sw.dropped++
+	}
+	sampleMu.Unlock()
+
+	if ok {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
+
+// Query parameters that never make it into logs
+var redactedParams = []string{"password", "password_mac"}
+
+/*
+ * The URL of a request as we log it, without secrets from the query
+ */
+func loggableURL(u *url.URL) string {
+	q := u.Query()
+	redacted := false
+	for _, p := range redactedParams {
+		if q.Has(p) {
+			q.Set(p, "[redacted]")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.String()
+	}
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.String()
+}
@@ -0,0 +1,62 @@
+package main
+
+/*
+ * Maintenance mode, for bucket migrations and backend maintenance windows:
+ * uploads are turned away with a 503 and MaintenanceMessage, downloads keep
+ * working. Start in it with Maintenance = true, switch with POST/DELETE
+ * /api/maintenance, or toggle with SIGUSR1.
+ */
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+var maintenanceFlag atomic.Bool
+
+func inMaintenance() bool {
+	return maintenanceFlag.Load()
+}
+
+func setMaintenance(on bool) {
+	if maintenanceFlag.Swap(on) != on {
+		log.Println("Maintenance mode:", on)
+	}
+}
+
+/*
+ * Answers 503 for uploads during maintenance. Returns false if the request
+ * should not go on.
+ */
+func checkMaintenance(w http.ResponseWriter) bool {
+	if !inMaintenance() {
+		return true
+	}
+	w.Header().Set("Retry-After", "600")
+	httpError(w, "maintenance", conf.MaintenanceMessage, 503)
+	return false
+}
+
+/*
+ * POST /api/maintenance starts maintenance mode, DELETE ends it, GET
+ * reports it
+ */
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	switch r.Method {
+	case "POST":
+		setMaintenance(true)
+	case "DELETE":
+		setMaintenance(false)
+	case "GET":
+	default:
+		http.Error(w, "405 Method Not Allowed", 405)
+		return
+	}
+	writeJSON(w, 200, struct {
+		Maintenance bool
+	}{inMaintenance()})
+}
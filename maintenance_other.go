@@ -0,0 +1,6 @@
+//go:build windows || plan9
+
+package main
+
+// No SIGUSR1 here, use the API
+func watchMaintenanceSignal() {}
@@ -0,0 +1,130 @@
+package main
+
+/*
+ * Batch authorization of several uploads at once (galleries, albums): the
+ * caller posts a manifest of files and gets signed PUT URLs for each, all
+ * under a common group ID.
+ */
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const manifestBucket = "manifests"
+
+// Don't let a single manifest authorize an unbounded number of uploads
+const maxManifestFiles = 100
+
+type manifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Type   string `json:"type,omitempty"`
+	Key    string `json:"key"`
+	PutURL string `json:"put_url"`
+	GetURL string `json:"get_url"`
+}
+
+type uploadManifest struct {
+	Group    string         `json:"group"`
+	Prefix   string         `json:"prefix,omitempty"`
+	Uploader string         `json:"uploader,omitempty"`
+	Created  time.Time      `json:"created"`
+	Files    []manifestFile `json:"files"`
+}
+
+/*
+ * Signs a PUT for key with our current secret and scheme
+ */
+func signedPutURL(key string, size int64, ctype string) string {
+	s := macSchemes[conf.Scheme]
+	u := url.URL{Path: "/" + conf.UploadSubDir + key}
+	u.RawQuery = url.Values{s.param: {s.sign(settings().Secret, key, size, ctype)}}.Encode()
+	return u.String()
+}
+
+func downloadURL(key string) string {
+	if conf.SignedDownloads {
+		return signedDownloadURL(key)
+	}
+	return (&url.URL{Path: "/" + conf.UploadSubDir + key}).String()
+}
+
+/*
+ * POST /api/manifests registers a group, GET /api/manifests/<group> returns
+ * it again (the latter only with MetadataDB)
+ */
+func handleManifests(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+
+	group := strings.TrimPrefix(r.URL.Path, "/api/manifests/")
+	if r.Method == "GET" && group != r.URL.Path && group != "" {
+		if metaDB == nil {
+			http.Error(w, "501 Needs MetadataDB", 501)
+			return
+		}
+		var m uploadManifest
+		found := false
+		metaDB.View(func(tx *bolt.Tx) error {
+			found = metaGet(tx, manifestBucket, group, &m)
+			return nil
+		})
+		if !found {
+			http.Error(w, "404 Not Found", 404)
+			return
+		}
+		writeJSON(w, 200, m)
+		return
+	} else if r.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed", 405)
+		return
+	}
+
+	var m uploadManifest
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil || len(m.Files) == 0 || len(m.Files) > maxManifestFiles {
+		http.Error(w, "400 Bad Request", 400)
+		return
+	}
+	m.Group = randomToken()
+	m.Created = time.Now()
+	m.Prefix = strings.Trim(m.Prefix, "/")
+
+	for i := range m.Files {
+		f := &m.Files[i]
+		name := path.Base("/" + f.Name)
+		if name == "/" || f.Size < 0 {
+			http.Error(w, "400 Bad file name or size", 400)
+			return
+		}
+		f.Key = path.Join(m.Prefix, m.Group, name)
+		if rej := checkUpload(userOf(f.Key), f.Key, f.Size); rej != nil {
+			http.Error(w, strconv.Itoa(rej.status)+" "+name+": "+rej.reason, rej.status)
+			return
+		}
+		f.PutURL = signedPutURL(f.Key, f.Size, f.Type)
+		f.GetURL = downloadURL(f.Key)
+	}
+
+	if metaDB != nil {
+		err := metaDB.Update(func(tx *bolt.Tx) error {
+			return metaPut(tx, manifestBucket, m.Group, &m)
+		})
+		if err != nil {
+			log.Println("Failed to store manifest:", err)
+			http.Error(w, "500 Internal Server Error", 500)
+			return
+		}
+	}
+	log.Printf("Authorized %d uploads in group %s for %q", len(m.Files), m.Group, m.Uploader)
+	writeJSON(w, 201, m)
+}
@@ -0,0 +1,124 @@
+package main
+
+/*
+ * Guards against running out of memory under a burst of large uploads.
+ * Uploads that don't go in a single S3 request (from MultipartThreshold on,
+ * or of unknown size after compression) are sent in parts, each buffered in
+ * memory: up to PartSize per upload, and MaxBufferMemory for all of them
+ * together. Beyond that, uploads are spooled to SpoolDir first, or turned
+ * away with a 503. MaxInFlightBytes caps the total size of all uploads in
+ * progress.
+ */
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	memMu         sync.Mutex
+	inFlightBytes int64
+	bufferedBytes int64
+)
+
+var (
+	inFlightBytesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "prosody_filer_upload_bytes_in_flight",
+		Help: "Declared size of all uploads in progress.",
+	})
+	bufferedBytesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "prosody_filer_upload_buffer_bytes",
+		Help: "Memory reserved for buffering upload parts.",
+	})
+	spooledUploads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "prosody_filer_spooled_uploads_total",
+		Help: "Uploads written to SpoolDir because the buffer memory was used up.",
+	})
+)
+
+func reserve(counter *int64, limit, n int64, gauge prometheus.Gauge) bool {
+	memMu.Lock()
+	defer memMu.Unlock()
+	if limit > 0 && *counter > 0 && *counter+n > limit {
+		return false
+	}
+	*counter += n
+	gauge.Set(float64(*counter))
+	return true
+}
+
+func release(counter *int64, n int64, gauge prometheus.Gauge) {
+	memMu.Lock()
+	defer memMu.Unlock()
+	*counter -= n
+	gauge.Set(float64(*counter))
+}
+
+func reserveInFlight(n int64) bool {
+	return reserve(&inFlightBytes, conf.MaxInFlightBytes, n, inFlightBytesGauge)
+}
+
+func releaseInFlight(n int64) {
+	release(&inFlightBytes, n, inFlightBytesGauge)
+}
+
+/*
+ * Memory buffered for an upload of size bytes (-1 if not known): nothing for
+ * uploads below MultipartThreshold, which are streamed in a single request,
+ * or to local storage, which are written straight to disk, one part
+ * otherwise
+ */
+func uploadBufferCost(size int64, resumable bool) int64 {
+	if conf.StorageType == "local" || (!resumable && size >= 0 && !streamedUpload(size)) {
+		return 0
+	}
+	if size >= 0 && size < conf.PartSize {
+		return size
+	}
+	if size < 0 {
+		return conf.PartSize
+	}
+	return partSizeFor(size)
+}
+
+func reserveBuffer(n int64) bool {
+	return reserve(&bufferedBytes, conf.MaxBufferMemory, n, bufferedBytesGauge)
+}
+
+func releaseBuffer(n int64) {
+	release(&bufferedBytes, n, bufferedBytesGauge)
+}
+
+/*
+ * Writes an upload to a temporary file in SpoolDir, so it can be sent to S3
+ * from there without buffering. Remove it with removeSpool when done.
+ */
+func spoolUpload(body io.Reader) (*os.File, int64, error) {
+	f, err := ioutil.TempFile(conf.SpoolDir, "upload-")
+	if err != nil {
+		return nil, 0, err
+	}
+	spooledUploads.Inc()
+	n, err := io.Copy(f, body)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSpool(f)
+		return nil, 0, err
+	}
+	return f, n, nil
+}
+
+func removeSpool(f *os.File) {
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		log.Println("Failed to remove spool file:", err)
+	}
+}
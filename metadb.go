@@ -0,0 +1,67 @@
+package main
+
+/*
+ * Optional local metadata database (bbolt), for the features that need to
+ * remember things S3 can't tell us cheaply. Everything that uses it is
+ * disabled when MetadataDB isn't configured.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var metaDB *bolt.DB
+
+var errNoMetadataDB = errors.New("no MetadataDB configured")
+
+func openMetadataDB() {
+	if conf.MetadataDB == "" {
+		return
+	}
+	var err error
+	metaDB, err = bolt.Open(conf.MetadataDB, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		log.Fatalln("Can't open MetadataDB:", err)
+	}
+	log.Println("Opened metadata database", conf.MetadataDB)
+}
+
+/*
+ * Helpers for storing JSON records in a bbolt bucket
+ */
+func metaGet(tx *bolt.Tx, bucket, key string, v interface{}) bool {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return false
+	}
+	data := b.Get([]byte(key))
+	if data == nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+func metaPut(tx *bolt.Tx, bucket, key string, v interface{}) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+func metaDelete(tx *bolt.Tx, bucket, key string) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
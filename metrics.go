@@ -0,0 +1,328 @@
+package main
+
+/*
+ * Prometheus metrics, served on a separate listener (MetricsListenport) so
+ * they don't end up exposed on the public upload URL. Where only one port
+ * can be reached, MetricsToken serves them on /metrics of the main listener
+ * too, to scrapers sending it as a bearer token.
+ */
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	minio "github.com/minio/minio-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var macVerifications = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "prosody_filer_mac_verifications_total",
+	Help: "Upload signature checks, by scheme and secret (current/previous) that matched.",
+}, []string{"scheme", "secret", "result"})
+
+var (
+	// 1 KiB .. 4 GiB
+	sizeBuckets = prometheus.ExponentialBuckets(1024, 4, 12)
+
+	transferBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prosody_filer_transfer_bytes_total",
+		Help: "Bytes received from (in) and sent to (out) clients.",
+	}, []string{"direction", "method", "result"})
+	uploadSizes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prosody_filer_upload_size_bytes",
+		Help:    "Sizes of upload request bodies.",
+		Buckets: sizeBuckets,
+	}, []string{"method", "result"})
+	downloadSizes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prosody_filer_download_size_bytes",
+		Help:    "Sizes of proxied downloads (redirects aren't counted, S3 sends those).",
+		Buckets: sizeBuckets,
+	}, []string{"method", "result"})
+)
+
+/*
+ * Per file rather than per request method, so a dashboard doesn't need to
+ * know which methods and statuses mean what
+ */
+var (
+	uploads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prosody_filer_uploads_total",
+		Help: "File uploads (PUT), by result: ok or error.",
+	}, []string{"result"})
+	downloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prosody_filer_downloads_total",
+		Help: "File downloads (GET), by result: ok (proxied), redirect (to S3), not_modified, not_found or error.",
+	}, []string{"result"})
+)
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prosody_filer_requests_total",
+		Help: "Requests by method and HTTP status.",
+	}, []string{"method", "status"})
+	requestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prosody_filer_request_errors_total",
+		Help: "Failed requests by error class, to tell client misbehaviour from backend trouble.",
+	}, []string{"method", "class"})
+	inFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "prosody_filer_requests_in_flight",
+		Help: "Requests currently being handled.",
+	})
+)
+
+/*
+ * Security-relevant events, for fail2ban-style automation and alerting
+ * without having to parse logs
+ */
+var securityEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "prosody_filer_security_events_total",
+	Help: "Rejected requests that may point at abuse: invalid or missing signatures, expired links, unauthorized API calls, bad upload sessions.",
+}, []string{"event"})
+
+func init() {
+	// Export all events at zero so alerts on increase() work from the start
+	for _, event := range []string{"invalid_mac", "missing_mac", "invalid_download_mac", "invalid_delete_mac", "expired_link", "invalid_variant_mac", "api_unauthorized", "session_rejected", "wrong_file_password"} {
+		securityEvents.WithLabelValues(event)
+	}
+}
+
+func securityEvent(event string) {
+	securityEvents.WithLabelValues(event).Inc()
+}
+
+var (
+	tenantRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prosody_filer_tenant_requests_total",
+		Help: "Requests by tenant (domain), method and HTTP status.",
+	}, []string{"tenant", "method", "status"})
+	tenantBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prosody_filer_tenant_transfer_bytes_total",
+		Help: "Bytes received from (in) and sent to (out) clients, by tenant (domain).",
+	}, []string{"tenant", "direction"})
+)
+
+var (
+	tenantsMu   sync.Mutex
+	tenantsSeen = map[string]bool{}
+)
+
+/*
+ * The tenant label for a request: the domain it was sent to. Only domains
+ * in MetricsTenants get their own label if that's set, otherwise the first
+ * MaxMetricsTenants domains seen do. Everything else is "other", so a
+ * client sending random Host headers can't blow up the metrics.
+ */
+func tenantLabel(r *http.Request) string {
+	tenant := requestHost(r)
+	if len(conf.MetricsTenants) > 0 {
+		for _, t := range conf.MetricsTenants {
+			if strings.EqualFold(t, tenant) {
+				return tenant
+			}
+		}
+		return "other"
+	}
+	tenantsMu.Lock()
+	defer tenantsMu.Unlock()
+	if !tenantsSeen[tenant] {
+		if len(tenantsSeen) >= conf.MaxMetricsTenants {
+			return "other"
+		}
+		tenantsSeen[tenant] = true
+	}
+	return tenant
+}
+
+/*
+ * http.Error, also recording the class of error for the metrics. Classes
+ * are things like "invalid_mac", "too_large" or "s3_timeout".
+ */
+func httpError(w http.ResponseWriter, class string, msg string, status int) {
+	if rec, ok := w.(*responseRecorder); ok {
+		rec.class = class
+	}
+	http.Error(w, msg, status)
+}
+
+/*
+ * Error class for a failed storage call
+ */
+func storageErrorClass(err error) string {
+	if errors.As(err, new(clientReadError)) {
+		return "client_abort"
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return "s3_timeout"
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return "not_found"
+	}
+	return "s3_error"
+}
+
+/*
+ * Keeps track of the status code and bytes sent for a response
+ */
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	class   string
+	written int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(p)
+	rec.written += int64(n)
+	return n, err
+}
+
+// For http.ResponseController (flushing event streams)
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+/*
+ * Counts bytes read from a request body
+ */
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.read += int64(n)
+	if err != nil && err != io.EOF {
+		err = clientReadError{err}
+	}
+	return n, err
+}
+
+/*
+ * Reading the request body failed, e.g. because the client went away. Not
+ * the backend's fault, even when it surfaces from a storage call.
+ */
+type clientReadError struct {
+	err error
+}
+
+func (e clientReadError) Error() string {
+	return "reading request body: " + e.err.Error()
+}
+
+func (e clientReadError) Unwrap() error {
+	return e.err
+}
+
+/*
+ * Wraps request and response so recordTransfer can tell how it went
+ */
+func instrument(w http.ResponseWriter, r *http.Request) (*responseRecorder, *countingReader) {
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+	inFlight.Inc()
+	atomic.AddInt64(&statInFlight, 1)
+	return rec, body
+}
+
+func recordTransfer(r *http.Request, rec *responseRecorder, body *countingReader) {
+	inFlight.Dec()
+	atomic.AddInt64(&statInFlight, -1)
+	countStats(rec, body)
+	result := "ok"
+	if rec.status >= 400 {
+		result = "error"
+	}
+	requests.WithLabelValues(r.Method, strconv.Itoa(rec.status)).Inc()
+	switch r.Method {
+	case "PUT":
+		uploads.WithLabelValues(result).Inc()
+	case "GET":
+		downloads.WithLabelValues(downloadResult(rec.status)).Inc()
+	}
+	if rec.class != "" {
+		requestErrors.WithLabelValues(r.Method, rec.class).Inc()
+	}
+	if body.read > 0 || r.Method == "PUT" {
+		transferBytes.WithLabelValues("in", r.Method, result).Add(float64(body.read))
+		uploadSizes.WithLabelValues(r.Method, result).Observe(float64(body.read))
+	}
+	if rec.written > 0 || r.Method == "GET" {
+		transferBytes.WithLabelValues("out", r.Method, result).Add(float64(rec.written))
+		if rec.written > 0 {
+			downloadSizes.WithLabelValues(r.Method, result).Observe(float64(rec.written))
+		}
+	}
+	if conf.TenantMetrics {
+		tenant := tenantLabel(r)
+		tenantRequests.WithLabelValues(tenant, r.Method, strconv.Itoa(rec.status)).Inc()
+		tenantBytes.WithLabelValues(tenant, "in").Add(float64(body.read))
+		tenantBytes.WithLabelValues(tenant, "out").Add(float64(rec.written))
+	}
+}
+
+func downloadResult(status int) string {
+	switch {
+	case status == http.StatusNotModified:
+		return "not_modified"
+	case status == http.StatusNotFound:
+		return "not_found"
+	case status >= 300 && status < 400:
+		return "redirect"
+	case status >= 400:
+		return "error"
+	}
+	return "ok"
+}
+
+/*
+ * GET /metrics on the main listener, with MetricsToken set
+ */
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	got := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(got, []byte("Bearer "+conf.MetricsToken)) != 1 {
+		log.Println("Metrics: unauthorized request from", r.RemoteAddr)
+		securityEvent("api_unauthorized")
+		http.Error(w, "401 Unauthorized", 401)
+		return
+	}
+	promhttp.Handler().ServeHTTP(w, r)
+}
+
+func serveMetrics() {
+	if conf.MetricsListenport == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	// Bind right away, before we drop privileges
+	ln, err := net.Listen("tcp", conf.MetricsListenport)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go func() {
+		log.Printf("Serving metrics on %s/metrics\n", conf.MetricsListenport)
+		log.Fatalln(http.Serve(ln, mux))
+	}()
+}
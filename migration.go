@@ -0,0 +1,277 @@
+package main
+
+/*
+ * Live migration between S3 services. The old bucket is configured as the
+ * legacy storage: reads that miss on the primary (new) storage fall back to
+ * it, removals apply to both, and with DualWrite every new upload is copied
+ * there as well, so Filers still using only the old bucket keep seeing
+ * everything until the switch-over is complete. Then the legacy settings
+ * can be dropped and the old bucket retired.
+ *
+ * With ReadRepair, files found only in the legacy bucket are copied to the
+ * primary in the background as they're read, so a migration completes
+ * itself over time. Files can also come from the directory of an old
+ * (non-S3) prosody-filer, LegacyDirectory; those are always copied to S3
+ * first since that's where we serve from.
+ */
+
+import (
+	"context"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var legacyClient *minio.Client
+
+var (
+	legacyReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prosody_filer_legacy_reads_total",
+		Help: "Reads that missed on the primary storage and went to the legacy storage, by operation and result.",
+	}, []string{"operation", "result"})
+	dualWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prosody_filer_dual_writes_total",
+		Help: "Copies of new uploads to the legacy storage (DualWrite), by result.",
+	}, []string{"result"})
+	readRepairs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prosody_filer_read_repairs_total",
+		Help: "Files copied from legacy storage to the primary on read, by source (bucket, directory) and result.",
+	}, []string{"source", "result"})
+)
+
+// Keys being copied forward right now
+var repairing sync.Map
+
+var errLegacyNotFound = minio.ErrorResponse{Code: "NoSuchKey", Message: "not in legacy storage", StatusCode: http.StatusNotFound}
+
+func hasLegacy() bool {
+	return legacyClient != nil || conf.LegacyDirectory != ""
+}
+
+func legacyLogin() {
+	if conf.LegacyDirectory != "" {
+		log.Println("Falling back to legacy directory", conf.LegacyDirectory)
+	}
+	if conf.LegacyS3Bucket == "" {
+		return
+	}
+	var err error
+	legacyClient, err = minio.New(conf.LegacyS3Endpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(conf.LegacyS3AccessKey, conf.LegacyS3Secret, ""),
+		Secure:    conf.LegacyS3TLS,
+		Transport: storageTransport(conf.LegacyS3TLS),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("Falling back to legacy storage %s/%s, dual write %v", conf.LegacyS3Endpoint, conf.LegacyS3Bucket, conf.DualWrite)
+}
+
+func isNotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+func legacyResult(op string, err error) {
+	result := "ok"
+	if isNotFound(err) {
+		result = "not_found"
+	} else if err != nil {
+		result = "error"
+	}
+	legacyReads.WithLabelValues(op, result).Inc()
+}
+
+func legacyGet(ctx context.Context, key string) (StorageObject, error) {
+	if legacyClient != nil {
+		obj, err := legacyClient.GetObject(ctx, conf.LegacyS3Bucket, key, minio.GetObjectOptions{})
+		if err == nil {
+			if _, err = obj.Stat(); err != nil {
+				obj.Close()
+			}
+		}
+		legacyResult("get", err)
+		if err == nil && conf.ReadRepair {
+			go readRepair(key)
+		}
+		if err == nil {
+			return obj, nil
+		} else if !isNotFound(err) || conf.LegacyDirectory == "" {
+			return nil, err
+		}
+	}
+	if err := copyFromDirectory(ctx, key); err != nil {
+		return nil, err
+	}
+	obj, err := backend.Get(ctx, key)
+	if err == nil {
+		if _, err = obj.Stat(); err != nil {
+			obj.Close()
+			return nil, err
+		}
+	}
+	return obj, err
+}
+
+func legacyStat(ctx context.Context, key string) (minio.ObjectInfo, error) {
+	if legacyClient != nil {
+		info, err := legacyClient.StatObject(ctx, conf.LegacyS3Bucket, key, minio.StatObjectOptions{})
+		legacyResult("stat", err)
+		if !isNotFound(err) || conf.LegacyDirectory == "" {
+			return info, err
+		}
+	}
+	fi, err := os.Stat(legacyFile(key))
+	legacyResult("stat_directory", err)
+	if err != nil || !fi.Mode().IsRegular() {
+		return minio.ObjectInfo{}, errLegacyNotFound
+	}
+	return minio.ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+		ContentType:  mime.TypeByExtension(filepath.Ext(key)),
+	}, nil
+}
+
+/*
+ * Where the old prosody-filer kept this file
+ */
+func legacyFile(key string) string {
+	return filepath.Join(conf.LegacyDirectory, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func copyFromDirectory(ctx context.Context, key string) error {
+	if conf.LegacyDirectory == "" {
+		return errLegacyNotFound
+	}
+	f, err := os.Open(legacyFile(key))
+	if err != nil {
+		return errLegacyNotFound
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return errLegacyNotFound
+	}
+	ch := make(http.Header)
+	addContentHeaders(ch, key)
+	_, err = backend.Put(ctx, key, f, fi.Size(), minio.PutObjectOptions{
+		ContentType:        ch.Get("Content-Type"),
+		ContentDisposition: ch.Get("Content-Disposition"),
+		PartSize:           uint64(conf.PartSize),
+	})
+	if err != nil {
+		log.Printf("Failed to copy %s from legacy directory: %v", key, err)
+		readRepairs.WithLabelValues("directory", "error").Inc()
+		return err
+	}
+	log.Printf("Copied %s from legacy directory", key)
+	readRepairs.WithLabelValues("directory", "ok").Inc()
+	return nil
+}
+
+/*
+ * Copies a file found in the legacy bucket to the primary
+ */
+func readRepair(key string) {
+	if _, busy := repairing.LoadOrStore(key, true); busy {
+		return
+	}
+	defer repairing.Delete(key)
+	if err := copyObject(context.Background(), legacyClient, conf.LegacyS3Bucket, s3Client, conf.S3Bucket, key); err != nil {
+		log.Printf("Read repair of %s failed: %v", key, err)
+		readRepairs.WithLabelValues("bucket", "error").Inc()
+		return
+	}
+	log.Printf("Read repair: copied %s from legacy bucket", key)
+	readRepairs.WithLabelValues("bucket", "ok").Inc()
+}
+
+/*
+ * Streams an object from one client/bucket to another, with its metadata
+ */
+func copyObject(ctx context.Context, from *minio.Client, fromBucket string, to *minio.Client, toBucket, key string) error {
+	obj, err := from.GetObject(ctx, fromBucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	info, err := obj.Stat()
+	if err != nil {
+		return err
+	}
+	opt := minio.PutObjectOptions{
+		ContentType:        info.ContentType,
+		ContentEncoding:    info.Metadata.Get("Content-Encoding"),
+		ContentDisposition: info.Metadata.Get("Content-Disposition"),
+		UserMetadata:       info.UserMetadata,
+		PartSize:           uint64(conf.PartSize),
+	}
+	_, err = to.PutObject(ctx, toBucket, key, obj, info.Size, opt)
+	return err
+}
+
+/*
+ * Presigned URLs are made offline, so check where the object actually is
+ */
+func legacyPresign(ctx context.Context, key string, expiry time.Duration, params url.Values) (*url.URL, bool, error) {
+	if _, err := backend.Stat(ctx, key); !isNotFound(err) {
+		return nil, false, nil
+	}
+	if legacyClient != nil {
+		if _, err := legacyClient.StatObject(ctx, conf.LegacyS3Bucket, key, minio.StatObjectOptions{}); err == nil {
+			if conf.ReadRepair {
+				go readRepair(key)
+			}
+			u, err := legacyClient.PresignedGetObject(ctx, conf.LegacyS3Bucket, key, expiry, params)
+			return u, true, err
+		}
+	}
+	// Files from the directory can only be served once they're in S3, after
+	// which the primary URL works
+	copyFromDirectory(ctx, key)
+	return nil, false, nil
+}
+
+func legacyRemove(ctx context.Context, key string) error {
+	if conf.LegacyDirectory != "" {
+		if err := os.Remove(legacyFile(key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if legacyClient == nil {
+		return nil
+	}
+	err := legacyClient.RemoveObject(ctx, conf.LegacyS3Bucket, key, minio.RemoveObjectOptions{})
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+/*
+ * Copies a new upload to the legacy storage. Failures are logged and
+ * counted but don't fail the upload, the primary copy is what counts.
+ */
+func dualWrite(ctx context.Context, key string) {
+	if legacyClient == nil || !conf.DualWrite {
+		return
+	}
+	if err := copyObject(ctx, s3Client, conf.S3Bucket, legacyClient, conf.LegacyS3Bucket, key); err != nil {
+		log.Printf("Dual write of %s to legacy storage failed: %v", key, err)
+		dualWrites.WithLabelValues("error").Inc()
+		return
+	}
+	dualWrites.WithLabelValues("ok").Inc()
+}
@@ -0,0 +1,259 @@
+package main
+
+/*
+ * Our own S3 multipart handling, so that interrupted uploads can be resumed
+ * (ResumableUploads). A client retrying the same signed URL can continue
+ * where it left off by sending Content-Range (or Upload-Offset) and only
+ * the remaining bytes. How far we got can be queried with a HEAD on the
+ * signed URL with an Upload-Length header, answered with Upload-Offset.
+ *
+ * Parts are all PartSize bytes except the last, so the bytes committed are
+ * simply the sum of the consecutive parts stored so far.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	minio "github.com/minio/minio-go"
+)
+
+var s3Core minio.Core
+
+/*
+ * Returned when a client tries to resume from further than we got
+ */
+type resumeError struct {
+	committed int64
+}
+
+func (e resumeError) Error() string {
+	return fmt.Sprintf("can't resume, only have %d bytes", e.committed)
+}
+
+/*
+ * Works out the total size the MAC covers and where this request's body
+ * starts, from Content-Range or Upload-Offset
+ */
+func uploadRange(r *http.Request) (size, offset int64, err error) {
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		var end int64
+		if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &offset, &end, &size); err != nil {
+			return 0, 0, err
+		}
+		if offset < 0 || end < offset || end >= size || end-offset+1 != r.ContentLength {
+			return 0, 0, fmt.Errorf("bad Content-Range %q", cr)
+		}
+		return size, offset, nil
+	}
+	if uo := r.Header.Get("Upload-Offset"); uo != "" {
+		offset, err = strconv.ParseInt(uo, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("bad Upload-Offset %q", uo)
+		}
+		return offset + r.ContentLength, offset, nil
+	}
+	return r.ContentLength, 0, nil
+}
+
+/*
+ * Finds the most recent incomplete multipart upload for key, and its parts
+ */
+func findMultipart(ctx context.Context, key string) (string, []minio.ObjectPart, error) {
+	res, err := storageListMultipart(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+	var upload *minio.ObjectMultipartInfo
+	for i, u := range res.Uploads {
+		if u.Key == key && (upload == nil || u.Initiated.After(upload.Initiated)) {
+			upload = &res.Uploads[i]
+		}
+	}
+	if upload == nil {
+		return "", nil, nil
+	}
+
+	var parts []minio.ObjectPart
+	marker := 0
+	for {
+		lp, err := storageListParts(ctx, key, upload.UploadID, marker)
+		if err != nil {
+			return "", nil, err
+		}
+		parts = append(parts, lp.ObjectParts...)
+		if !lp.IsTruncated {
+			break
+		}
+		marker = lp.NextPartNumberMarker
+	}
+	return upload.UploadID, parts, nil
+}
+
+/*
+ * The run of consecutive parts from part 1, and how many bytes they hold
+ */
+func committedParts(parts []minio.ObjectPart) ([]minio.CompletePart, int64) {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	var done []minio.CompletePart
+	var committed int64
+	for i, p := range parts {
+		if p.PartNumber != i+1 {
+			break
+		}
+		done = append(done, minio.CompletePart{PartNumber: p.PartNumber, ETag: p.ETag})
+		committed += p.Size
+	}
+	return done, committed
+}
+
+/*
+ * Uploads body, which holds the object from offset onwards, as a multipart
+ * upload, continuing an earlier attempt if there is one. On errors the
+ * incomplete upload is left in place so the client can resume it.
+ */
+func putMultipart(ctx context.Context, key string, body io.Reader, offset, size int64, opt minio.PutObjectOptions) (minio.UploadInfo, error) {
+	uploadID, parts, err := findMultipart(ctx, key)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	if uploadID != "" && offset == 0 {
+		// Client started over, so will we
+		if err := storageAbortMultipart(ctx, key, uploadID); err != nil {
+			log.Println("Failed to abort earlier multipart upload:", err)
+		}
+		uploadID, parts = "", nil
+	}
+	if uploadID == "" {
+		if offset != 0 {
+			return minio.UploadInfo{}, resumeError{0}
+		}
+		if uploadID, err = storageNewMultipart(ctx, key, opt); err != nil {
+			return minio.UploadInfo{}, err
+		}
+	}
+
+	done, committed := committedParts(parts)
+	if offset > committed {
+		return minio.UploadInfo{}, resumeError{committed}
+	}
+	if offset > 0 {
+		log.Printf("Resuming upload of %s at %d bytes (client sent from %d)", key, committed, offset)
+	}
+	if _, err := io.CopyN(ioutil.Discard, body, committed-offset); err != nil {
+		return minio.UploadInfo{}, err
+	}
+
+	if done, err = putParts(ctx, key, uploadID, body, committed, size, done); err != nil {
+		return minio.UploadInfo{}, err
+	}
+	return storageCompleteMultipart(ctx, key, uploadID, done, opt)
+}
+
+/*
+ * Whether an upload of size bytes (-1 if not known) goes to S3 with
+ * putStreamed rather than in a single request. An empty one has no parts to
+ * send.
+ */
+func streamedUpload(size int64) bool {
+	return size > 0 && size >= conf.MultipartThreshold && conf.StorageType != "local"
+}
+
+/*
+ * Uploads body, all size bytes of it, as a multipart upload without the
+ * resume bookkeeping: an upload that fails is aborted.
+ */
+func putStreamed(ctx context.Context, key string, body io.Reader, size int64, opt minio.PutObjectOptions) (minio.UploadInfo, error) {
+	uploadID, err := storageNewMultipart(ctx, key, opt)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	done, err := putParts(ctx, key, uploadID, body, 0, size, nil)
+	var info minio.UploadInfo
+	if err == nil {
+		info, err = storageCompleteMultipart(ctx, key, uploadID, done, opt)
+	}
+	if err != nil {
+		if err := storageAbortMultipart(context.Background(), key, uploadID); err != nil {
+			log.Println("Failed to abort multipart upload:", err)
+		}
+	}
+	return info, err
+}
+
+/*
+ * Sends body, the object from pos up to size, as the parts following done,
+ * reading one part at a time
+ */
+func putParts(ctx context.Context, key, uploadID string, body io.Reader, pos, size int64, done []minio.CompletePart) ([]minio.CompletePart, error) {
+	partSize := partSizeFor(size)
+	buf := make([]byte, partSize)
+	for pos < size {
+		n := size - pos
+		if n > partSize {
+			n = partSize
+		}
+		if _, err := io.ReadFull(body, buf[:n]); err != nil {
+			return done, err
+		}
+		part, err := storagePutPart(ctx, key, uploadID, len(done)+1, buf[:n])
+		if err != nil {
+			return done, err
+		}
+		done = append(done, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+		pos += n
+	}
+	return done, nil
+}
+
+// S3 limits for multipart uploads
+const (
+	minPartSize = 5 << 20
+	maxPartSize = 5 << 30
+	maxParts    = 10000
+)
+
+/*
+ * PartSize, or bigger (in whole MiB) for objects that wouldn't fit in
+ * maxParts parts of it. Only depends on the size, so a resumed upload gets
+ * the same parts.
+ */
+func partSizeFor(size int64) int64 {
+	ps := conf.PartSize
+	if need := (size + maxParts - 1) / maxParts; need > ps {
+		ps = (need + 1<<20 - 1) &^ (1<<20 - 1)
+	}
+	return ps
+}
+
+/*
+ * HEAD on a signed upload URL with Upload-Length: tells the client how many
+ * bytes we have, so it knows where to resume
+ */
+func serveUploadOffset(w http.ResponseWriter, r *http.Request, fileStorePath string, a url.Values) {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || !verifyMAC(fileStorePath, size, r.Header.Get("Content-Type"), a) {
+		httpError(w, "invalid_mac", "403 Forbidden", 403)
+		return
+	}
+
+	var committed int64
+	if info, err := storageStat(r.Context(), fileStorePath); err == nil && info.Size == size {
+		committed = size
+	} else if _, parts, err := findMultipart(r.Context(), fileStorePath); err == nil {
+		_, committed = committedParts(parts)
+	} else {
+		log.Println("Storage error:", err)
+		httpError(w, storageErrorClass(err), "Storage error", 502)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(committed, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(size, 10))
+}
@@ -0,0 +1,97 @@
+package main
+
+/*
+ * Incomplete multipart uploads (from crashes, or resumable uploads that
+ * were never finished) are invisible in the bucket listing but their parts
+ * are stored, and billed, forever. Abort those older than MultipartMaxAge,
+ * at startup and every hour after. The same goes for chunks (ChunkedUploads)
+ * that were never composed.
+ */
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var staleMultipartAborted = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "prosody_filer_stale_multipart_aborted_total",
+	Help: "Incomplete multipart uploads aborted for being older than MultipartMaxAge.",
+})
+
+var staleChunksRemoved = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "prosody_filer_stale_chunks_removed_total",
+	Help: "Upload chunks removed for not being composed within MultipartMaxAge.",
+})
+
+func abortStaleMultipart(ctx context.Context, olderThan time.Time) (int, error) {
+	aborted := 0
+	keyMarker, uploadIDMarker := "", ""
+	for {
+		res, err := storageListMultipartPage(ctx, keyMarker, uploadIDMarker)
+		if err != nil {
+			return aborted, err
+		}
+		for _, u := range res.Uploads {
+			if u.Initiated.After(olderThan) {
+				continue
+			}
+			if err := storageAbortMultipart(ctx, u.Key, u.UploadID); err != nil {
+				log.Printf("Failed to abort stale multipart upload of %s: %v", u.Key, err)
+				continue
+			}
+			log.Printf("Aborted stale multipart upload of %s, started %v", u.Key, u.Initiated)
+			staleMultipartAborted.Inc()
+			aborted++
+		}
+		if !res.IsTruncated {
+			return aborted, nil
+		}
+		keyMarker, uploadIDMarker = res.NextKeyMarker, res.NextUploadIDMarker
+	}
+}
+
+func removeStaleChunks(ctx context.Context, olderThan time.Time) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	removed := 0
+	for obj := range storageList(ctx, chunkPrefix) {
+		if obj.Err != nil {
+			return removed, obj.Err
+		}
+		if obj.LastModified.After(olderThan) {
+			continue
+		}
+		if err := storageRemove(ctx, obj.Key); err != nil {
+			log.Printf("Failed to remove stale chunk %s: %v", obj.Key, err)
+			continue
+		}
+		staleChunksRemoved.Inc()
+		removed++
+	}
+	if removed > 0 {
+		log.Println("Removed", removed, "stale upload chunks")
+	}
+	return removed, nil
+}
+
+func cleanupStaleMultipart() {
+	if conf.MultipartMaxAge <= 0 {
+		return
+	}
+	for {
+		olderThan := time.Now().Add(-conf.MultipartMaxAge)
+		if _, err := abortStaleMultipart(context.Background(), olderThan); err != nil {
+			log.Println("Failed to clean up stale multipart uploads:", err)
+		}
+		if conf.ChunkedUploads {
+			if _, err := removeStaleChunks(context.Background(), olderThan); err != nil {
+				log.Println("Failed to clean up stale chunks:", err)
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+/*
+ * OMEMO (and other end-to-end encrypted) uploads are ciphertext, but keep
+ * the extension of the original file. With DetectOMEMO we sniff uploads, and
+ * files whose contents don't look anything like their extension claims are
+ * stored as opaque: application/octet-stream, always as attachment, and not
+ * thumbnailed or compressed.
+ */
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+/*
+ * Whether http.DetectContentType can recognise this type at all, otherwise
+ * there's no point comparing
+ */
+func isSniffable(ctype string) bool {
+	for _, p := range []string{"image/", "audio/", "video/", "text/", "application/pdf"} {
+		if strings.HasPrefix(ctype, p) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Magic numbers of common chat media formats http.DetectContentType doesn't
+ * know, which would otherwise look like ciphertext
+ */
+var knownMagic = []struct {
+	offset int
+	magic  string
+}{
+	// ISO base media: HEIC, AVIF, M4A, MOV, 3GP
+	{4, "ftyp"},
+	// MP3, with ID3 tag or starting with a frame
+	{0, "ID3"}, {0, "\xff\xfb"}, {0, "\xff\xf3"}, {0, "\xff\xf2"},
+	// AAC (ADTS), FLAC, AMR
+	{0, "\xff\xf1"}, {0, "\xff\xf9"}, {0, "fLaC"}, {0, "#!AMR"},
+	// TIFF and most camera raw formats
+	{0, "II*\x00"}, {0, "MM\x00*"},
+	// JPEG XL
+	{0, "\xff\x0a"}, {4, "JXL "},
+}
+
+func hasKnownMagic(head []byte) bool {
+	for _, m := range knownMagic {
+		if len(head) >= m.offset+len(m.magic) && string(head[m.offset:m.offset+len(m.magic)]) == m.magic {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Peeks at the start of the upload, returning a reader with the full body
+ * and whether it looks like ciphertext
+ */
+func sniffOpaque(body io.Reader, ctype string) (io.Reader, bool) {
+	br := bufio.NewReaderSize(body, 512)
+	if !isSniffable(ctype) {
+		return br, false
+	}
+	head, _ := br.Peek(512)
+	return br, looksOpaque(head, ctype)
+}
+
+/*
+ * Whether a file of type ctype starting with head looks like ciphertext
+ */
+func looksOpaque(head []byte, ctype string) bool {
+	if !isSniffable(ctype) || len(head) == 0 {
+		return false
+	}
+	return http.DetectContentType(head) == "application/octet-stream" && !hasKnownMagic(head)
+}
+
+func markOpaque(opt *minio.PutObjectOptions) {
+	opt.ContentType = "application/octet-stream"
+	opt.ContentDisposition = "attachment"
+	if opt.UserMetadata == nil {
+		opt.UserMetadata = make(map[string]string)
+	}
+	opt.UserMetadata["Opaque"] = "1"
+}
+
+func isStoredOpaque(info minio.ObjectInfo) bool {
+	return info.Metadata.Get("X-Amz-Meta-Opaque") == "1"
+}
+
+func setOpaqueHeaders(h http.Header) {
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Disposition", "attachment")
+}
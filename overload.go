@@ -0,0 +1,101 @@
+package main
+
+/*
+ * Load shedding: when we're over a limit (concurrent uploads, bytes in
+ * flight, buffer memory) or the backend is down, uploads are turned away
+ * with a 503 and Retry-After as soon as the headers are in, before reading
+ * the body. Clients sending Expect: 100-continue then don't send it at all,
+ * instead of streaming the whole file only to time out.
+ *
+ * With MaxConcurrentRequests, downloads get priority: uploads may only take
+ * UploadShare of it, so a flood of uploads can't keep people from loading
+ * the media already in their chat history.
+ */
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// How long overloaded clients are asked to wait
+const overloadRetryAfter = 10 * time.Second
+
+var activeUploads, activeDownloads int64
+
+var shedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "prosody_filer_shed_requests_total",
+	Help: "Requests turned away with a 503 because of overload, by reason.",
+}, []string{"reason"})
+
+func shedLoad(w http.ResponseWriter, class, reason, msg string, retryAfter time.Duration) {
+	shedRequests.WithLabelValues(reason).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	httpError(w, class, "503 "+msg, 503)
+}
+
+/*
+ * Whether an upload needing buffer memory couldn't get any right now
+ */
+func bufferExhausted() bool {
+	memMu.Lock()
+	defer memMu.Unlock()
+	return conf.MaxBufferMemory > 0 && bufferedBytes > 0 && bufferedBytes+conf.PartSize > conf.MaxBufferMemory
+}
+
+/*
+ * Admits a PUT if we have room for it, otherwise answers 503. Call release
+ * when the upload is done.
+ */
+func admitUpload(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	n := atomic.AddInt64(&activeUploads, 1)
+	if conf.MaxConcurrentUploads > 0 && n > int64(conf.MaxConcurrentUploads) {
+		atomic.AddInt64(&activeUploads, -1)
+		shedLoad(w, "overloaded", "concurrency", "Too many uploads in progress", overloadRetryAfter)
+		return nil, false
+	}
+	if max := int64(conf.MaxConcurrentRequests); max > 0 {
+		if n > int64(float64(max)*conf.UploadShare) || n+atomic.LoadInt64(&activeDownloads) > max {
+			atomic.AddInt64(&activeUploads, -1)
+			shedLoad(w, "overloaded", "qos", "Too many uploads in progress", overloadRetryAfter)
+			return nil, false
+		}
+	}
+	size := r.ContentLength
+	if size < 0 {
+		size = 0
+	}
+	if !reserveInFlight(size) {
+		atomic.AddInt64(&activeUploads, -1)
+		shedLoad(w, "overloaded", "in_flight_bytes", "Too many uploads in progress", overloadRetryAfter)
+		return nil, false
+	}
+	if conf.SpoolDir == "" && streamedUpload(r.ContentLength) && bufferExhausted() {
+		releaseInFlight(size)
+		atomic.AddInt64(&activeUploads, -1)
+		shedLoad(w, "overloaded", "buffer_memory", "Server busy", overloadRetryAfter)
+		return nil, false
+	}
+	return func() {
+		releaseInFlight(size)
+		atomic.AddInt64(&activeUploads, -1)
+	}, true
+}
+
+/*
+ * Admits a GET or HEAD unless all of MaxConcurrentRequests is in use.
+ * Call release when done.
+ */
+func admitDownload(w http.ResponseWriter) (release func(), ok bool) {
+	n := atomic.AddInt64(&activeDownloads, 1)
+	if max := int64(conf.MaxConcurrentRequests); max > 0 && n+atomic.LoadInt64(&activeUploads) > max {
+		atomic.AddInt64(&activeDownloads, -1)
+		shedLoad(w, "overloaded", "qos", "Server busy", overloadRetryAfter)
+		return nil, false
+	}
+	return func() { atomic.AddInt64(&activeDownloads, -1) }, true
+}
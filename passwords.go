@@ -0,0 +1,228 @@
+package main
+
+/*
+ * Password protected files, for sharing sensitive documents with people
+ * outside the chat. The slot issuer can protect an upload by adding
+ * password=<password>&password_mac=<HMAC-SHA256 of "<path> <password>"> to
+ * the PUT URL (signed with the upload secret, so clients can't drop it),
+ * or an admin can set one later through the API. Downloads then need the
+ * password through HTTP basic auth (any user name), which browsers prompt
+ * for. Only a salted PBKDF2 hash is kept, in MetadataDB. An address that
+ * gets PasswordAttempts wrong in a minute is turned away with 429 for the
+ * rest of it, without hashing what it sends.
+ */
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const passwordBucket = "passwords"
+
+const passwordIterations = 100000
+
+type filePassword struct {
+	Salt       []byte `json:"salt"`
+	Hash       []byte `json:"hash"`
+	Iterations int    `json:"iterations"`
+}
+
+func hashPassword(password string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iterations, 32)
+}
+
+func setFilePassword(key, password string) error {
+	if metaDB == nil {
+		return errNoMetadataDB
+	}
+	p := filePassword{Salt: make([]byte, 16), Iterations: passwordIterations}
+	rand.Read(p.Salt)
+	var err error
+	if p.Hash, err = hashPassword(password, p.Salt, p.Iterations); err != nil {
+		return err
+	}
+	return metaDB.Update(func(tx *bolt.Tx) error {
+		return metaPut(tx, passwordBucket, key, p)
+	})
+}
+
+func clearFilePassword(key string) error {
+	if metaDB == nil {
+		return errNoMetadataDB
+	}
+	return metaDB.Update(func(tx *bolt.Tx) error {
+		return metaDelete(tx, passwordBucket, key)
+	})
+}
+
+func lookupFilePassword(key string) (p filePassword, found bool) {
+	if metaDB == nil || !conf.FilePasswords {
+		return p, false
+	}
+	metaDB.View(func(tx *bolt.Tx) error {
+		found = metaGet(tx, passwordBucket, key, &p)
+		return nil
+	})
+	return p, found
+}
+
+/*
+ * The password to protect an upload with, if the PUT URL has a correctly
+ * signed one. ok is false if there is one but the signature doesn't match.
+ */
+func uploadPassword(fileStorePath string, a url.Values, now time.Time) (password string, ok bool) {
+	password = a.Get("password")
+	if password == "" || !conf.FilePasswords {
+		return "", true
+	}
+	for _, k := range acceptedMACKeys(now) {
+		if hmac.Equal([]byte(hmacHex(k.secret, fileStorePath+" "+password)), []byte(a.Get("password_mac"))) {
+			return password, true
+		}
+	}
+	return "", false
+}
+
+type attemptWindow struct {
+	start  time.Time
+	failed int
+}
+
+var (
+	attemptsMu sync.Mutex
+	attempts   = make(map[string]*attemptWindow)
+)
+
+func attemptAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+/*
+ * How long the address has to wait before it may try another password
+ */
+func passwordLockout(addr string, now time.Time) time.Duration {
+	attemptsMu.Lock()
+	defer attemptsMu.Unlock()
+	aw := attempts[addr]
+	if conf.PasswordAttempts <= 0 || aw == nil || aw.failed < conf.PasswordAttempts {
+		return 0
+	}
+	return aw.start.Add(time.Minute).Sub(now)
+}
+
+func countWrongPassword(addr string, now time.Time) {
+	attemptsMu.Lock()
+	defer attemptsMu.Unlock()
+	aw := attempts[addr]
+	if aw == nil || now.Sub(aw.start) >= time.Minute {
+		// Forget everyone's old windows while we're at it
+		for k, v := range attempts {
+			if now.Sub(v.start) >= time.Minute {
+				delete(attempts, k)
+			}
+		}
+		aw = &attemptWindow{start: now}
+		attempts[addr] = aw
+	}
+	aw.failed++
+}
+
+const passwordPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Password required</title></head>
+<body><p>This file is password protected. Reload the page to enter the password.</p></body></html>
+`
+
+/*
+ * Checks the password of a protected file. Answers 401 and returns false if
+ * the request doesn't have it.
+ */
+func passwordAuthorized(w http.ResponseWriter, r *http.Request, key string) bool {
+	p, found := lookupFilePassword(key)
+	if !found {
+		return true
+	}
+	// Shared caches mustn't hand it out without the password
+	w.Header().Set("Cache-Control", "private, no-store")
+	addr, now := attemptAddr(r), time.Now()
+	if wait := passwordLockout(addr, now); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		httpError(w, "password_lockout", "429 Too many wrong passwords", 429)
+		return false
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		if hash, err := hashPassword(password, p.Salt, p.Iterations); err == nil && hmac.Equal(hash, p.Hash) {
+			return true
+		}
+		logSampled("wrong_file_password", "Wrong password for %s from %s", key, r.RemoteAddr)
+		securityEvent("wrong_file_password")
+		countWrongPassword(addr, now)
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="Password protected file", charset="UTF-8"`)
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(401)
+		w.Write([]byte(passwordPage))
+		return false
+	}
+	httpError(w, "password_required", "401 Password required", 401)
+	return false
+}
+
+/*
+ * PUT /api/passwords/<key> {"password": ...} protects a file, DELETE
+ * removes the protection
+ */
+func handlePasswords(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	if !conf.FilePasswords || metaDB == nil {
+		http.Error(w, "501 File passwords not enabled", 501)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/api/passwords/")
+	if key == "" {
+		http.Error(w, "400 Need key", 400)
+		return
+	}
+	var err error
+	switch r.Method {
+	case "PUT":
+		var req struct {
+			Password string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+			http.Error(w, "400 Need password", 400)
+			return
+		}
+		err = setFilePassword(key, req.Password)
+	case "DELETE":
+		err = clearFilePassword(key)
+	default:
+		http.Error(w, "405 Method Not Allowed", 405)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to update file password:", err)
+		http.Error(w, "500 Internal Server Error", 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
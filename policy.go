@@ -0,0 +1,170 @@
+package main
+
+/*
+ * Upload acceptance rules, checked on every PUT and available ahead of time
+ * through /api/check so the XMPP server (or client) can fail fast
+ */
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type uploadRejection struct {
+	status int
+	class  string // for metrics, see httpError
+	reason string
+}
+
+func (e *uploadRejection) Error() string {
+	return e.reason
+}
+
+/*
+ * The user an upload is accounted to: the first component of its path
+ */
+func userOf(fileStorePath string) string {
+	return strings.SplitN(strings.TrimPrefix(fileStorePath, "/"), "/", 2)[0]
+}
+
+func typeAllowed(ctype string) bool {
+	if len(conf.AllowedTypes) == 0 {
+		return true
+	}
+	ctype = strings.TrimSpace(strings.SplitN(ctype, ";", 2)[0])
+	for _, pattern := range conf.AllowedTypes {
+		if ok, _ := path.Match(pattern, ctype); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns why an upload of size bytes to fileStorePath by user would be
+ * rejected, or nil if it's fine
+ */
+func checkUpload(user, fileStorePath string, size int64) *uploadRejection {
+	if conf.MaxUploadSize > 0 && size > conf.MaxUploadSize {
+		return &uploadRejection{413, "too_large", "Payload Too Large"}
+	}
+	if rej := checkQuota(user, size); rej != nil {
+		return rej
+	}
+	ctype := mime.TypeByExtension(filepath.Ext(fileStorePath))
+	if !typeAllowed(ctype) {
+		return &uploadRejection{415, "type_not_allowed", "File type not allowed"}
+	}
+	return nil
+}
+
+/*
+ * Everything an upload has to pass once its URL checked out, however it
+ * comes in: the limits above, the per-prefix policy, UploadPolicy and
+ * HookPreAccept. Answers the request and returns false if it's turned away.
+ */
+func acceptUpload(w http.ResponseWriter, r *http.Request, fileStorePath string, size int64, ctype string) (effectivePolicy, hookEvent, bool) {
+	pol := storagePolicyFor(r, fileStorePath)
+	ev := hookEvent{
+		"key":         fileStorePath,
+		"user":        userOf(fileStorePath),
+		"size":        strconv.FormatInt(size, 10),
+		"type":        ctype,
+		"remote_addr": r.RemoteAddr,
+	}
+	rej := checkUpload(userOf(fileStorePath), fileStorePath, size)
+	if rej == nil && pol.maxFileSize > 0 && size > pol.maxFileSize {
+		rej = &uploadRejection{413, "too_large", "Payload Too Large"}
+	}
+	if rej == nil {
+		rej = checkUploadPolicy(r, fileStorePath, size, ctype)
+	}
+	if rej == nil {
+		rej = preAcceptHook(ev)
+	}
+	if rej != nil {
+		log.Println("Rejecting upload:", rej.reason)
+		httpError(w, rej.class, strconv.Itoa(rej.status)+" "+rej.reason, rej.status)
+		return pol, ev, false
+	}
+	return pol, ev, true
+}
+
+/*
+ * GET /api/check?user=<user>&size=<bytes>&name=<file name>
+ */
+func handleCheck(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	size, err := strconv.ParseInt(q.Get("size"), 10, 64)
+	if err != nil || size < 0 || q.Get("user") == "" {
+		http.Error(w, "400 Need user and size", 400)
+		return
+	}
+
+	resp := map[string]interface{}{"allowed": true}
+	if rej := checkUpload(q.Get("user"), path.Join(q.Get("user"), q.Get("name")), size); rej != nil {
+		log.Printf("Check: upload of %d bytes by %s would be rejected: %s", size, q.Get("user"), rej.reason)
+		resp["allowed"] = false
+		resp["status"] = rej.status
+		resp["reason"] = rej.reason
+	}
+	writeJSON(w, 200, resp)
+}
+
+/*
+ * Body reader that fails unless exactly the declared number of bytes is
+ * read, so a lying client can neither get a truncated file stored nor sneak
+ * in more data than the MAC authorized.
+ */
+type exactReader struct {
+	r         io.Reader
+	remaining int64
+	mismatch  bool
+}
+
+var errLengthMismatch = errors.New("request body doesn't match Content-Length")
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		// Make sure there's nothing more
+		var extra [1]byte
+		if n, _ := e.r.Read(extra[:]); n > 0 {
+			e.mismatch = true
+			return 0, errLengthMismatch
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if err != nil && e.remaining > 0 && !errors.As(err, new(*http.MaxBytesError)) {
+		// Short body: the client sent less than it said, or went away
+		e.mismatch = true
+		return n, errLengthMismatch
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+/*
+ * Whether everything was read and there's nothing beyond it. The S3 client
+ * stops reading at the size we give it, so this catches the excess.
+ */
+func (e *exactReader) drained() bool {
+	n, err := e.Read(make([]byte, 1))
+	return n == 0 && err == io.EOF
+}
@@ -0,0 +1,113 @@
+package main
+
+/*
+ * Site-specific upload rules in Starlark (a Python dialect), so operators
+ * don't need to recompile for things like "videos only for local users,
+ * under 50 MB". UploadPolicy names a script defining accept(upload), where
+ * upload has path, size, type, user, ip and host. It returns True to accept,
+ * False or a string (the reason, sent to the client) to reject. Scripts
+ * can use in_network(ip, "10.0.0.0/8").
+ *
+ * Evaluation is bounded by a step limit, and errors reject the upload.
+ */
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Enough for any sensible rule, stops runaway loops
+const policyMaxSteps = 100000
+
+var (
+	policyMu     sync.RWMutex
+	policyAccept *starlark.Function
+)
+
+var policyBuiltins = starlark.StringDict{
+	"in_network": starlark.NewBuiltin("in_network", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var ip, cidr string
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "ip", &ip, "cidr", &cidr); err != nil {
+			return nil, err
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		addr := net.ParseIP(ip)
+		return starlark.Bool(addr != nil && network.Contains(addr)), nil
+	}),
+}
+
+/*
+ * Compiles UploadPolicy, if set
+ */
+func loadUploadPolicy() error {
+	if conf.UploadPolicy == "" {
+		return nil
+	}
+	thread := &starlark.Thread{Name: "load " + conf.UploadPolicy}
+	globals, err := starlark.ExecFile(thread, conf.UploadPolicy, nil, policyBuiltins)
+	if err != nil {
+		return err
+	}
+	accept, ok := globals["accept"].(*starlark.Function)
+	if !ok || accept.NumParams() != 1 {
+		return fmt.Errorf("%s must define accept(upload)", conf.UploadPolicy)
+	}
+	globals.Freeze()
+	policyMu.Lock()
+	policyAccept = accept
+	policyMu.Unlock()
+	log.Println("Loaded upload policy from", conf.UploadPolicy)
+	return nil
+}
+
+/*
+ * Asks the policy about an upload of the given (declared) type. Returns nil
+ * if it may go ahead.
+ */
+func checkUploadPolicy(r *http.Request, fileStorePath string, size int64, ctype string) *uploadRejection {
+	policyMu.RLock()
+	accept := policyAccept
+	policyMu.RUnlock()
+	if accept == nil {
+		return nil
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	upload := starlarkstruct.FromStringDict(starlark.String("upload"), starlark.StringDict{
+		"path": starlark.String(fileStorePath),
+		"size": starlark.MakeInt64(size),
+		"type": starlark.String(ctype),
+		"user": starlark.String(userOf(fileStorePath)),
+		"ip":   starlark.String(ip),
+		"host": starlark.String(requestHost(r)),
+	})
+	thread := &starlark.Thread{Name: "accept " + fileStorePath}
+	thread.SetMaxExecutionSteps(policyMaxSteps)
+	res, err := starlark.Call(thread, accept, starlark.Tuple{upload}, nil)
+	if err != nil {
+		log.Println("Upload policy failed:", err)
+		return &uploadRejection{500, "policy_error", "Upload policy failed"}
+	}
+	switch v := res.(type) {
+	case starlark.Bool:
+		if v {
+			return nil
+		}
+		return &uploadRejection{403, "policy_rejected", "Rejected by policy"}
+	case starlark.String:
+		return &uploadRejection{403, "policy_rejected", string(v)}
+	}
+	log.Println("Upload policy returned", res.Type(), "instead of a bool or string")
+	return &uploadRejection{500, "policy_error", "Upload policy failed"}
+}
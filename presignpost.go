@@ -0,0 +1,76 @@
+package main
+
+/*
+ * S3 presigned POST policies, so browsers can upload straight to S3 and the
+ * Filer only authorizes: GET on the slot URL (with its MAC) plus
+ * policy=1&size=<bytes> returns the form to POST to S3, constrained to
+ * exactly that key, size and content type.
+ */
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// How long a browser has to start the upload
+const postPolicyValidity = 15 * time.Minute
+
+func servePostPolicy(w http.ResponseWriter, r *http.Request, fileStorePath string, a url.Values) {
+	if !conf.PresignedPost || conf.ProxyMode || encryptionKey != nil {
+		httpError(w, "bad_request", "400 Presigned POST not enabled", 400)
+		return
+	}
+	size, err := strconv.ParseInt(a.Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		httpError(w, "bad_request", "400 Need size", 400)
+		return
+	}
+	if conf.RequireUploadSessions {
+		log.Println("Error: No upload session in URL.")
+		securityEvent("session_rejected")
+		httpError(w, "session", "Needs upload session", 403)
+		return
+	}
+	if !hasMAC(a) {
+		logSampled("missing_mac", "Error: No HMAC attached to URL.")
+		securityEvent("missing_mac")
+		httpError(w, "missing_mac", "Needs HMAC", 403)
+		return
+	}
+	if !verifyMAC(fileStorePath, size, a.Get("type"), a) {
+		httpError(w, "invalid_mac", "403 Forbidden", 403)
+		return
+	}
+	// The upload itself goes straight to S3, so it's now or never
+	if _, _, ok := acceptUpload(w, r, fileStorePath, size, a.Get("type")); !ok {
+		return
+	}
+
+	ch := make(http.Header)
+	addContentHeaders(ch, fileStorePath)
+	ctype := ch.Get("Content-Type")
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	policy := minio.NewPostPolicy()
+	policy.SetBucket(conf.S3Bucket)
+	policy.SetKey(fileStorePath)
+	policy.SetExpires(time.Now().UTC().Add(postPolicyValidity))
+	policy.SetContentLengthRange(size, size)
+	policy.SetContentType(ctype)
+	policy.SetContentDisposition(ch.Get("Content-Disposition"))
+
+	u, fields, err := storagePresignPost(context.Background(), policy)
+	if err != nil {
+		log.Println("Failed to presign POST policy:", err)
+		httpError(w, storageErrorClass(err), "Backend Error", 502)
+		return
+	}
+	writeJSON(w, 200, map[string]interface{}{"url": u.String(), "fields": fields})
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+func dropPrivileges() error {
+	if conf.User != "" || conf.Group != "" || conf.Chroot != "" {
+		return errors.New("User, Group and Chroot are not supported on this platform")
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+//go:build !windows && !plan9
+
+package main
+
+/*
+ * Dropping root after binding the listeners, so the Filer can listen on
+ * port 443 itself without running as root. Everything that needs files
+ * (metadata DB, audit log) has been opened by then.
+ */
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+func dropPrivileges() error {
+	if conf.User == "" && conf.Group == "" && conf.Chroot == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if conf.User != "" {
+		u, err := user.Lookup(conf.User)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if conf.Group != "" {
+		g, err := user.LookupGroup(conf.Group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if conf.Chroot != "" {
+		// Load the CA certificates for talking to S3 while we still can
+		if _, err := x509.SystemCertPool(); err != nil {
+			log.Println("Failed to load system CA certificates:", err)
+		}
+		if err := syscall.Chroot(conf.Chroot); err != nil {
+			return fmt.Errorf("chroot %s: %v", conf.Chroot, err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	// Group first, we can't change it anymore once we've given up root
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %v", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid %d: %v", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid %d: %v", uid, err)
+		}
+	}
+	log.Printf("Dropped privileges to uid %d gid %d (chroot %q)", syscall.Getuid(), syscall.Getgid(), conf.Chroot)
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+/*
+ * Server-side upload progress as Server-Sent Events, for web clients behind
+ * proxies that buffer the request body (where the browser's own progress
+ * just jumps to 100%). The client picks a random token, adds it to the PUT
+ * URL as "progress=<token>" and opens an EventSource on the same URL with
+ * the same parameter; knowing the token is what authorizes listening.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tokens must be hard to guess
+const minProgressTokenLength = 16
+
+// How long a listener waits for the upload to start, and how long the
+// result stays around for listeners that connect late
+const progressWait = 30 * time.Second
+
+type uploadProgress struct {
+	key      string
+	total    int64
+	received int64 // atomic
+	status   int
+	done     chan struct{}
+}
+
+var (
+	progressMu     sync.Mutex
+	progressTokens = map[string]*uploadProgress{}
+)
+
+func validProgressToken(token string) bool {
+	return conf.ProgressEvents && len(token) >= minProgressTokenLength
+}
+
+func trackProgress(token, key string, total int64) *uploadProgress {
+	p := &uploadProgress{key: key, total: total, done: make(chan struct{})}
+	progressMu.Lock()
+	progressTokens[token] = p
+	progressMu.Unlock()
+	return p
+}
+
+func (p *uploadProgress) finish(token string, status int) {
+	p.status = status
+	close(p.done)
+	time.AfterFunc(progressWait, func() {
+		progressMu.Lock()
+		if progressTokens[token] == p {
+			delete(progressTokens, token)
+		}
+		progressMu.Unlock()
+	})
+}
+
+func lookupProgress(token string) *uploadProgress {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	return progressTokens[token]
+}
+
+/*
+ * Counts bytes of the upload body as they come in
+ */
+type progressReader struct {
+	r io.Reader
+	p *uploadProgress
+}
+
+func (pr progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	atomic.AddInt64(&pr.p.received, int64(n))
+	return n, err
+}
+
+func sendEvent(w http.ResponseWriter, event string, data interface{}) error {
+	js, _ := json.Marshal(data)
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, js); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+/*
+ * GET <file URL>?progress=<token>: "progress" events with the bytes received
+ * so far, then one "done" event with the upload's HTTP status
+ */
+func serveProgress(w http.ResponseWriter, r *http.Request, fileStorePath, token string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	waitUntil := time.Now().Add(progressWait)
+	for {
+		p := lookupProgress(token)
+		if p != nil && p.key != fileStorePath {
+			p = nil
+		}
+		if p == nil && time.Now().After(waitUntil) {
+			sendEvent(w, "error", map[string]string{"error": "no such upload"})
+			return
+		}
+		if p != nil {
+			select {
+			case <-p.done:
+				sendEvent(w, "done", map[string]int64{"received": atomic.LoadInt64(&p.received), "total": p.total, "status": int64(p.status)})
+				return
+			default:
+			}
+			if sendEvent(w, "progress", map[string]int64{"received": atomic.LoadInt64(&p.received), "total": p.total}) != nil {
+				return
+			}
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -7,20 +7,22 @@ package main
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -35,15 +37,297 @@ import (
 type Config struct {
 	Listenport   string
 	Secret       string
+	Scheme       string
+	AuthScheme   string // another name for Scheme
 	UploadSubDir string
 
+	// Accepted alongside Secret/Scheme until PreviousUntil, for migrations.
+	PreviousSecret string
+	PreviousScheme string
+	PreviousUntil  time.Time
+
+	// Reject unsigned GET/HEAD requests
+	SignedDownloads      bool
+	DownloadLinkValidity time.Duration
+
+	// Let uploaders retract files with a signed DELETE link
+	DeleteLinks        bool
+	DeleteLinkValidity time.Duration
+
+	// Signed, resized versions of images (proxied through the Filer)
+	Thumbnails        bool
+	ThumbnailMaxWidth int
+
+	// Also accept nginx secure_link signatures (secure_link_md5 expression)
+	SecureLinkMD5 string
+
+	// Bearer token for the /api/ endpoints (disabled if unset)
+	APIToken string
+	// Local database for features that need state (sessions etc.)
+	MetadataDB string
+
+	// Hash-chained log of deletions, written before executing them
+	AuditLog string
+	// Audit events to syslog/journald: "local" or udp://host:514
+	AuditSyslog string
+
+	// Upload sessions registered through the API
+	UploadSessionTTL      time.Duration
+	RequireUploadSessions bool
+
+	// Serve HTTPS with this certificate, reloaded when the files change
+	TLSCert string
+	TLSKey  string
+	// Plain HTTP listener that only redirects to HTTPS
+	HTTPRedirectListenport string
+	// Get certificates for these names over ACME instead
+	ACMEDomains      []string
+	ACMEEmail        string
+	ACMECacheDir     string
+	ACMEDirectoryURL string
+
+	// "tcp", "tcp4" or "tcp6"
+	ListenNetwork string
+	// For Listenport "unix:/path": permissions (octal) and group of the socket
+	SocketMode  string
+	SocketGroup string
+
+	// Open the listener with SO_REUSEPORT, AcceptLoops times
+	ReusePort   bool
+	AcceptLoops int
+
+	// After binding, switch to this user/group and chroot
+	User   string
+	Group  string
+	Chroot string
+	// Refuse to start unless running with FIPS 140-3 validated crypto
+	RequireFIPS bool
+
+	// Linux: restrict file access to our own directories (Landlock)
+	Sandbox      bool
+	SandboxPaths []string
+
+	// On SIGTERM, report not ready for DrainDelay before shutting down, and
+	// give in-flight requests up to ShutdownTimeout to finish
+	DrainDelay      time.Duration
+	ShutdownTimeout time.Duration
+
+	// Background probing of the backend, and the circuit breaker
+	HealthCheckInterval time.Duration
+	HealthCheckKey      string
+	BreakerThreshold    int
+	BreakerCooldown     time.Duration
+
+	// CDN in front of the download domain, to purge and prefetch files on
+	CDNProvider string
+	CDNBaseURL  string
+	CDNZone     string
+	CDNToken    string
+	CDNWebhook  string
+	CDNPrefetch bool
+
+	// Notifications when things cross these thresholds
+	AlertInterval      time.Duration
+	AlertErrorRate     float64
+	AlertStorageUsage  int64
+	AlertUsageInterval time.Duration
+	AlertWebhook       string
+	AlertXMPPURL       string
+	AlertEmail         []string
+	AlertEmailFrom     string
+	AlertSMTPServer    string
+	AlertSMTPUser      string
+	AlertSMTPPassword  string
+
+	// XEP-0114 component answering XEP-0363 slot requests itself
+	ComponentJID    string
+	ComponentServer string
+	ComponentSecret string
+	ComponentURL    string
+	// Domains whose users get slots, the one above ComponentJID if unset
+	ComponentDomains []string
+
+	// Log details of a fraction of requests
+	Debug           bool
+	DebugSampleRate float64
+
+	// Don't log every request, only errors
+	QuietLogs bool
+	// Max. number of repetitive messages (invalid MACs etc.) logged per minute
+	LogSampleBurst int
+
+	MetricsListenport string
+	// Also serve /metrics on the main listener, to requests with this token
+	MetricsToken      string
+	TenantMetrics     bool
+	MetricsTenants    []string
+	MaxMetricsTenants int
+	// Pushgateway and/or remote-write receiver to push metrics to
+	MetricsPushURL        string
+	MetricsRemoteWriteURL string
+	MetricsPushInterval   time.Duration
+	MetricsPushJob        string
+	MetricsPushInstance   string
+
 	ProxyMode bool
 
+	// MIME type patterns (e.g. "image/*") uploads must match, all if empty
+	AllowedTypes []string
+	// Content types by file extension, over the system's mime.types
+	MimeTypes map[string]string
+
+	// Limits on memory used for uploads: buffers for all uploads together
+	// (spilling to SpoolDir beyond that) and total size of uploads
+	MaxBufferMemory  int64
+	SpoolDir         string
+	MaxInFlightBytes int64
+	// Number of uploads handled at the same time, unlimited if 0
+	MaxConcurrentUploads int
+	// Uploads and downloads handled at the same time, of which uploads may
+	// take UploadShare, so downloads still get through under upload floods
+	MaxConcurrentRequests int
+	UploadShare           float64
+
+	// Short download links (/d/<code>) in MetadataDB, sent in a Link header
+	ShortLinks bool
+
+	// Read back IntegrityCheckSample random files this often and verify
+	// their recorded hashes
+	IntegrityCheckInterval time.Duration
+	IntegrityCheckSample   int
+
+	// Starlark script deciding on uploads, see policyscript.go
+	UploadPolicy string
+
+	// Executables run on upload lifecycle events
+	HookPreAccept  string
+	HookPostUpload string
+	HookPostDelete string
+	HookTimeout    time.Duration
+
+	// Turn away uploads (see /api/maintenance), with this message
+	Maintenance        bool
+	MaintenanceMessage string
+
+	// Download hosts (and certificates) by tenant domain
+	Tenants map[string]TenantConfig
+	// Encryption, storage class, retention etc. by key prefix or tenant
+	StoragePolicies []StoragePolicy
+
+	// Keep search engines out: /robots.txt, X-Robots-Tag on downloads
+	RobotsTxt string
+	NoIndex   bool
+
+	// Answer 410 with a message by removal action for removed files
+	Tombstones        bool
+	TombstoneMessages map[string]string
+
+	// Let uploads be password protected (in MetadataDB), with this many
+	// wrong passwords per address and minute
+	FilePasswords    bool
+	PasswordAttempts int
+
+	// Count downloads per file in MetadataDB, written every
+	// DownloadFlushInterval
+	DownloadTracking      bool
+	DownloadFlushInterval time.Duration
+
+	// Drag-and-drop upload page at /share/ for these users (name: password)
+	WebUploadUsers map[string]string
+
+	// Hand out presigned S3 POST policies for direct browser uploads
+	PresignedPost bool
+
+	// Report upload progress as Server-Sent Events (?progress=<token>)
+	ProgressEvents bool
+
+	// Answer retried PUTs of files we already have without storing again
+	IdempotentUploads bool
+	// Don't need the body of uploads with a Content-Digest we already have
+	SkipIdenticalUploads bool
+
+	// Larger uploads get 413, 0 for no limit
+	MaxUploadSize int64
+	// Bytes each user may have stored, with exceptions by user
+	UserQuota  int64
+	UserQuotas map[string]int64
+	// Remove files (under RetentionPrefix) older than this, or have the
+	// bucket's lifecycle rules do it
+	RetentionDays   int
+	RetentionPrefix string
+	ManageLifecycle bool
+
+	// Let clients resume interrupted uploads bigger than PartSize
+	ResumableUploads bool
+	PartSize         int64
+	// Uploads from this size on are sent to S3 part by part
+	MultipartThreshold int64
+	// Abort incomplete multipart uploads older than this
+	MultipartMaxAge time.Duration
+
+	// Accept uploads in chunks, concatenated by a final compose call
+	ChunkedUploads bool
+
+	// Store text-like uploads gzipped
+	CompressText bool
+	// Store uploads that look like ciphertext as opaque attachments
+	DetectOMEMO bool
+	// Hex AES-256 key, encrypt new uploads at rest if set
+	EncryptionKey string
+	// Program printing the hex key, e.g. after unwrapping it with a KMS
+	EncryptionKeyCommand string
+
 	S3Endpoint  string
 	S3AccessKey string
 	S3Secret    string
 	S3TLS       bool
 	S3Bucket    string
+
+	// Multi-homed hosts: "tcp4"/"tcp6", and the source address (or
+	// interface) for connections to S3
+	S3Network       string
+	S3SourceAddress string
+	S3Interface     string
+	// Drop idle connections this often, so DNS changes are picked up
+	S3ConnRefresh time.Duration
+	// Deadlines for storage calls: quick ones, and transfers, which also
+	// get the time their size takes at S3MinThroughput bytes/s
+	S3Timeout         time.Duration
+	S3TransferTimeout time.Duration
+	S3MinThroughput   int64
+
+	// Local cache of recent uploads, served while the backend is down
+	CacheDir         string
+	CacheSize        int64
+	CacheMaxFileSize int64
+
+	// Migration: old storage to fall back to for reads, and to copy new
+	// uploads to as well with DualWrite
+	LegacyS3Endpoint  string
+	LegacyS3AccessKey string
+	LegacyS3Secret    string
+	LegacyS3TLS       bool
+	LegacyS3Bucket    string
+	DualWrite         bool
+	// Copy files found only in legacy storage to S3Bucket when read
+	ReadRepair bool
+	// Files of a (non-S3) prosody-filer to migrate, copied to S3 when read
+	LegacyDirectory string
+
+	// Serve our own S3-compatible store from this directory instead
+	EmbeddedStorage string
+	// "s3", or "local" to keep plain files in StorageRoot like the
+	// original prosody-filer
+	StorageType string
+	StorageRoot string
+
+	// Testing only: drop this fraction of client connections midway
+	ChaosAbortRate float64
+
+	// Testing only: fail or delay this fraction of storage requests
+	FaultErrorRate   float64
+	FaultLatencyRate float64
+	FaultLatency     time.Duration
 }
 
 var conf Config
@@ -51,13 +335,25 @@ var s3Client *minio.Client
 
 const ALLOWED_METHODS string = "OPTIONS, HEAD, GET, PUT"
 
+func allowedMethods() string {
+	methods := ALLOWED_METHODS
+	if conf.ChunkedUploads {
+		methods += ", POST"
+	}
+	if conf.DeleteLinks {
+		methods += ", DELETE"
+	}
+	return methods
+}
+
 /*
  * Sets CORS headers
  */
 func addCORSheaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", ALLOWED_METHODS)
-	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", allowedMethods())
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Content-Range, Upload-Offset, Upload-Length, Want-Repr-Digest, Want-Digest")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Link, ETag, Repr-Digest, Digest")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 	w.Header().Set("Access-Control-Max-Age", "7200")
 }
@@ -72,17 +368,67 @@ func addContentHeaders(h http.Header, filename string) {
 	}
 }
 
+func handleRobots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(conf.RobotsTxt))
+}
+
+/*
+ * ?dl=1 makes any file a download instead of being shown inline
+ */
+func forceDownload(h http.Header, filename string, a url.Values) {
+	if dl := a.Get("dl"); dl == "" || dl == "0" {
+		return
+	}
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(filename)}))
+}
+
+/*
+ * /raw/<file URL path> is the same as the file URL with ?dl=1, /view/ the
+ * same as the plain file URL (shown inline where that's safe)
+ */
+func handleDownloadVariant(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "405 Method Not Allowed", 405)
+		return
+	}
+	r = r.Clone(r.Context())
+	if strings.HasPrefix(r.URL.Path, "/raw/") {
+		if r.URL.RawQuery != "" {
+			r.URL.RawQuery += "&"
+		}
+		r.URL.RawQuery += "dl=1"
+	}
+	r.URL.Path = r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:]
+	if !strings.HasPrefix(r.URL.Path, "/"+conf.UploadSubDir) {
+		http.NotFound(w, r)
+		return
+	}
+	handleRequest(w, r)
+}
+
 /*
  * Request handler
- * Is activated when a clients requests the file, file information or an upload
+ * Is activated when a clients requests the file, file information or an upload.
+ * Does what all requests need, then hands them to the pipeline for their
+ * method in fileRoutes.
  */
 func handleRequest(w http.ResponseWriter, r *http.Request) {
-	log.Println("Incoming request:", r.Method, r.URL.String())
+	logRequest("Incoming request:", r.Method, loggableURL(r.URL))
+
+	r = startDebug(r)
+	w, r = chaos(w, r)
+	rec, body := instrument(w, r)
+	defer recordTransfer(r, rec, body)
+	defer streamRequestAudit(r, rec, body)
+	defer finishDebug(r, rec)
 
 	// Parse URL and args
 	u, err := url.Parse(r.URL.String())
 	if err != nil {
 		log.Println("Failed to parse URL:", err)
+		httpError(rec, "bad_request", "400 Bad Request", 400)
+		return
 	}
 
 	a, err := url.ParseQuery(u.RawQuery)
@@ -90,113 +436,707 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		log.Println("Failed to parse URL query params:", err)
 	}
 
-	fileStorePath := strings.TrimPrefix(u.Path, "/"+conf.UploadSubDir)
-
 	// Add CORS headers
-	addCORSheaders(w)
+	addCORSheaders(rec)
 
-	if r.Method == "PUT" {
-		// Check if MAC is attached to URL
-		if a["v"] == nil {
-			log.Println("Error: No HMAC attached to URL.")
-			http.Error(w, "Needs HMAC", 403)
+	f := &fileRequest{path: strings.TrimPrefix(u.Path, "/"+conf.UploadSubDir), args: a, rec: rec}
+	routeFile(rec, r.WithContext(context.WithValue(r.Context(), fileRequestKey{}, f)))
+}
+
+func handlePut(w http.ResponseWriter, r *http.Request, f *fileRequest) {
+	fileStorePath, a, rec := f.path, f.args, f.rec
+	if a.Get("chunk") != "" {
+		handleChunk(w, r, fileStorePath, a)
+		return
+	}
+
+	/*
+	 * Check whether the MAC the client sent in the URL matches any of the
+	 * secrets/schemes we currently accept
+	 */
+	logRequest("fileStorePath:", fileStorePath)
+	logRequest("ContentLength:", r.ContentLength)
+	if r.ContentLength < 0 {
+		// The MAC covers the size, so we need to know it up front
+		log.Println("Error: No Content-Length.")
+		httpError(w, "bad_request", "411 Length Required", 411)
+		return
+	}
+	declared, offset, err := uploadRange(r)
+	if err != nil {
+		log.Println("Error:", err)
+		httpError(w, "bad_request", "400 Bad Request", 400)
+		return
+	}
+	debugMAC(r, fileStorePath, declared, r.Header.Get("Content-Type"))
+	session := a.Get("session")
+	if session != "" {
+		err := claimSession(session, fileStorePath, declared, r.Header.Get("Content-Type"))
+		if err == errSessionUsed {
+			log.Println("Error:", err)
+			httpError(w, "session", "409 Conflict", 409)
+			return
+		} else if err != nil {
+			log.Println("Error:", err)
+			securityEvent("session_rejected")
+			httpError(w, "session", "403 Forbidden", 403)
 			return
 		}
-
-		/*
-		 * Check if the request is valid
-		 */
-		mac := hmac.New(sha256.New, []byte(conf.Secret))
-		log.Println("fileStorePath:", fileStorePath)
-		log.Println("ContentLength:", strconv.FormatInt(r.ContentLength, 10))
-		mac.Write([]byte(fileStorePath + " " + strconv.FormatInt(r.ContentLength, 10)))
-		macString := hex.EncodeToString(mac.Sum(nil))
-
-		/*
-		 * Check whether calculated (expected) MAC is the MAC that client send in "v" URL parameter
-		 */
-		if !hmac.Equal([]byte(macString), []byte(a["v"][0])) {
-			log.Println("Invalid MAC, expected:", macString)
-			http.Error(w, "403 Forbidden", 403)
+		// Free it up for a retry unless we get to store it, however we return
+		defer func() { finishSession(session, rec.status == http.StatusCreated) }()
+	} else if conf.RequireUploadSessions {
+		log.Println("Error: No upload session in URL.")
+		securityEvent("session_rejected")
+		httpError(w, "session", "Needs upload session", 403)
+		return
+	} else if secureLinkRequest(a) {
+		if !verifySecureLink(r, a, time.Now()) {
+			httpError(w, "invalid_mac", "403 Forbidden", 403)
 			return
 		}
+	} else if !hasMAC(a) {
+		logSampled("missing_mac", "Error: No HMAC attached to URL.")
+		macVerifications.WithLabelValues("", "", "missing").Inc()
+		securityEvent("missing_mac")
+		httpError(w, "missing_mac", "Needs HMAC", 403)
+		return
+	} else if !verifyMAC(fileStorePath, declared, r.Header.Get("Content-Type"), a) {
+		httpError(w, "invalid_mac", "403 Forbidden", 403)
+		return
+	}
 
-		ch := make(http.Header)
-		addContentHeaders(ch, fileStorePath)
+	password, ok := uploadPassword(fileStorePath, a, time.Now())
+	if !ok {
+		log.Println("Error: Invalid password_mac")
+		securityEvent("invalid_mac")
+		httpError(w, "invalid_mac", "403 Forbidden", 403)
+		return
+	}
+	if offset == 0 && handleRetriedUpload(w, r, fileStorePath, declared, password) {
+		return
+	}
+	pol, hookInfo, ok := acceptUpload(w, r, fileStorePath, declared, r.Header.Get("Content-Type"))
+	if !ok {
+		return
+	}
+	if offset == 0 && handleIdenticalUpload(w, r, fileStorePath, declared, pol, password) {
+		return
+	}
+	if conf.MaxUploadSize > 0 {
+		// Whatever the headers said
+		r.Body = http.MaxBytesReader(w, r.Body, conf.MaxUploadSize)
+	}
+	ch := make(http.Header)
+	addContentHeaders(ch, fileStorePath)
 
-		// Somewhat redundant since we're setting these in the signed URL as well, but why not?
-		var opt minio.PutObjectOptions
-		opt.ContentType = ch.Get("Content-Type")
-		opt.ContentDisposition = ch.Get("Content-Disposition")
+	// Somewhat redundant since we're setting these in the signed URL as well, but why not?
+	var opt minio.PutObjectOptions
+	opt.ContentType = ch.Get("Content-Type")
+	opt.ContentDisposition = ch.Get("Content-Disposition")
+	// So we know how much memory the client buffers for uploads of unknown size
+	opt.PartSize = uint64(conf.PartSize)
+	opt.StorageClass = pol.storageClass
 
-		s3file, err := s3Client.PutObject(context.Background(), conf.S3Bucket, fileStorePath, r.Body, r.ContentLength, minio.PutObjectOptions{})
-		if err != nil {
-			log.Println("Uploading file failed:", err)
-			http.Error(w, "Backend Error", 502)
+	exact := &exactReader{r: r.Body, remaining: r.ContentLength}
+	// Hash and metadata of what the client sent, only complete without an offset
+	sniff := newMetaSniffer()
+	var body io.Reader = io.TeeReader(exact, sniff)
+	var cacheUpload *cacheWriter
+	if cw := newCacheWriter(declared); cw != nil && offset == 0 {
+		defer cw.finish(fileStorePath, false)
+		body = io.TeeReader(body, cw)
+		cacheUpload = cw
+	}
+	if token := a.Get("progress"); validProgressToken(token) {
+		p := trackProgress(token, fileStorePath, declared)
+		atomic.StoreInt64(&p.received, offset)
+		defer func() { p.finish(token, rec.status) }()
+		body = progressReader{body, p}
+	}
+	size := r.ContentLength
+	opaque := false
+	if conf.DetectOMEMO && offset == 0 {
+		if body, opaque = sniffOpaque(body, opt.ContentType); opaque {
+			log.Println("Upload looks like ciphertext, storing as opaque")
+			markOpaque(&opt)
+		}
+	}
+	if conf.CompressText && !opaque && isCompressible(opt.ContentType) {
+		var gz io.ReadCloser
+		gz, size = compressUpload(&opt, body, size)
+		// Stops it reading the request body if we don't get to storing it
+		defer gz.Close()
+		body = gz
+	}
+	if pol.encrypt {
+		var enc io.ReadCloser
+		enc, size = encryptUpload(&opt, body, size, declared)
+		defer enc.Close()
+		body = enc
+	}
+
+	// Large untransformed uploads can be resumed if they get interrupted
+	resumable := conf.ResumableUploads && offset+size == declared && !opaque && opt.ContentEncoding == "" && !pol.encrypt && declared > conf.PartSize
+	if offset > 0 && !resumable {
+		log.Println("Error: Can't resume this upload")
+		httpError(w, "bad_request", "400 Can't resume this upload", 400)
+		return
+	}
+
+	cost := uploadBufferCost(size, resumable)
+	if !reserveBuffer(cost) {
+		if conf.SpoolDir == "" || offset > 0 {
+			log.Println("Out of upload buffer memory, turning away upload")
+			shedLoad(w, "overloaded", "buffer_memory", "Server busy", overloadRetryAfter)
 			return
 		}
+		f, n, err := spoolUpload(body)
+		if exact.mismatch {
+			log.Println("Uploading file failed:", errLengthMismatch)
+			httpError(w, "length_mismatch", "400 Body doesn't match Content-Length", 400)
+			return
+		} else if err != nil {
+			log.Println("Failed to spool upload:", err)
+			httpError(w, "spool_error", "500 Internal Server Error", 500)
+			return
+		}
+		defer removeSpool(f)
+		body, size, resumable = f, n, false
+		cost = 0
+	}
+	defer releaseBuffer(cost)
 
-		log.Println("Successfully stored file with ETag", s3file.ETag)
-		w.WriteHeader(http.StatusCreated)
-	} else if r.Method == "HEAD" || r.Method == "GET" {
-		if conf.ProxyMode {
-			obj, err := s3Client.GetObject(context.Background(), conf.S3Bucket, fileStorePath, minio.GetObjectOptions{})
-			if err != nil {
-				log.Println("Storage error:", err)
-				http.Error(w, "Storage error", 502)
-				return
-			}
-			addContentHeaders(w.Header(), fileStorePath)
-			// Content-Length for HEAD?
-			if r.Method == "GET" {
-				http.ServeContent(w, r, fileStorePath, time.Now(), obj)
+	debugNote(r, "storage: put %d bytes (declared %d, offset %d), resumable %v, content type %q, encoding %q", size, declared, offset, resumable, opt.ContentType, opt.ContentEncoding)
+	ctx := context.Background()
+	if size < 0 {
+		// Compressed on the fly, so give it as long as the original would get
+		var cancel context.CancelFunc
+		ctx, cancel = withTimeout(ctx, transferTimeout(declared))
+		defer cancel()
+	}
+	var s3file minio.UploadInfo
+	if resumable {
+		s3file, err = putMultipart(ctx, fileStorePath, body, offset, declared, opt)
+	} else if streamedUpload(size) {
+		s3file, err = putStreamed(ctx, fileStorePath, body, size, opt)
+	} else {
+		s3file, err = storagePut(ctx, fileStorePath, body, size, opt)
+	}
+	if re, ok := err.(resumeError); ok {
+		log.Println("Uploading file failed:", err)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(re.committed, 10))
+		httpError(w, "bad_request", "416 Range Not Satisfiable", 416)
+		return
+	} else if exact.mismatch {
+		log.Println("Uploading file failed:", errLengthMismatch)
+		httpError(w, "length_mismatch", "400 Body doesn't match Content-Length", 400)
+		return
+	} else if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+		log.Println("Uploading file failed:", err)
+		httpError(w, "too_large", "413 Payload Too Large", 413)
+		return
+	} else if err != nil {
+		log.Println("Uploading file failed:", err)
+		httpError(w, storageErrorClass(err), "Backend Error", 502)
+		return
+	}
+
+	if !exact.drained() {
+		log.Println("Uploading file failed:", errLengthMismatch)
+		if err := storageRemove(context.Background(), fileStorePath); err != nil {
+			log.Println("Failed to remove mismatched upload:", err)
+		}
+		httpError(w, "length_mismatch", "400 Body doesn't match Content-Length", 400)
+		return
+	}
+
+	if password != "" {
+		if err := setFilePassword(fileStorePath, password); err != nil {
+			// Don't leave it unprotected
+			log.Println("Failed to store file password:", err)
+			if err := storageRemove(context.Background(), fileStorePath); err != nil {
+				log.Println("Failed to remove unprotected upload:", err)
 			}
+			httpError(w, "password_error", "500 Internal Server Error", 500)
+			return
+		}
+	}
+	logRequest("Successfully stored file with ETag", s3file.ETag)
+	if cacheUpload != nil {
+		cacheUpload.finish(fileStorePath, true)
+	}
+	if offset > 0 {
+		// Only the rest of the file went through here
+		sniff = nil
+	}
+	meta := finishUpload(fileStorePath, declared, opt.ContentType, pol, hookInfo, sniff)
+	if conf.SignedDownloads {
+		w.Header().Set("Location", tenantURL(r, signedDownloadURL(fileStorePath)))
+	}
+	if conf.ShortLinks {
+		if link, err := createShortLink(fileStorePath); err != nil {
+			log.Println("Failed to store short link:", err)
 		} else {
-			ch := make(http.Header)
-			addContentHeaders(ch, fileStorePath)
-			uv := make(url.Values)
-			for k, v := range ch {
-				uv.Set("response-"+strings.ToLower(k), v[0])
-			}
+			w.Header().Set("Link", "<"+tenantURL(r, link)+`>; rel="shortlink"`)
+		}
+	}
+	if conf.DeleteLinks {
+		w.Header().Add("Link", "<"+tenantURL(r, signedDeleteURL(fileStorePath))+`>; rel="delete"`)
+	}
+	if s3file.ETag != "" {
+		w.Header().Set("ETag", `"`+s3file.ETag+`"`)
+	}
+	if offset == 0 && strings.Contains(r.Header.Get("Accept"), "application/json") {
+		receipt := newUploadReceipt(fileStorePath, meta, s3file.ETag, time.Now())
+		receipt.URL = tenantURL(r, receipt.URL)
+		writeJSON(w, http.StatusCreated, receipt)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+/*
+ * The bookkeeping once an upload is stored, however it came in. sniff has
+ * seen the whole file, or is nil if it didn't; the metadata recorded from it
+ * is returned.
+ */
+func finishUpload(fileStorePath string, size int64, ctype string, pol effectivePolicy, ev hookEvent, sniff *metaSniffer) fileMetadata {
+	clearTombstone(fileStorePath)
+	recordRetention(fileStorePath, pol, time.Now())
+	recordUsage(fileStorePath, size)
+	dualWrite(context.Background(), fileStorePath)
+	var meta fileMetadata
+	if sniff != nil {
+		ev["sha256"] = sniff.sha256()
+	}
+	postHook(conf.HookPostUpload, "post-upload", ev)
+	cdnPrefetch(fileStorePath)
+	if sniff != nil {
+		recordHash(fileStorePath, sniff.sha256())
+		meta = sniff.metadata(fileStorePath, size, ctype)
+		recordFileMetadata(fileStorePath, meta)
+	}
+	return meta
+}
 
-			// NOTE: This is an offline operation, using just our credentials, so it'll work for any URL,
-			// it's up to the S3 backend to 404 if the file isn't there.
-			url, err := s3Client.PresignedGetObject(context.Background(), conf.S3Bucket, fileStorePath, 24*time.Hour, uv)
-			if err != nil {
-				log.Println("Storage error:", err)
-				http.Error(w, "Storage error", 502)
-				return
+func handlePost(w http.ResponseWriter, r *http.Request, f *fileRequest) {
+	if f.args.Get("compose") != "" {
+		handleCompose(w, r, f.path, f.args)
+		return
+	}
+	handleBadMethod(w, r, f)
+}
+
+/*
+ * GET and HEAD
+ */
+func handleGet(w http.ResponseWriter, r *http.Request, f *fileRequest) {
+	fileStorePath, a, rec := f.path, f.args, f.rec
+	var err error
+	if r.Method == "HEAD" && conf.ResumableUploads && r.Header.Get("Upload-Length") != "" {
+		serveUploadOffset(w, r, fileStorePath, a)
+		return
+	}
+	if token := a.Get("progress"); r.Method == "GET" && validProgressToken(token) {
+		serveProgress(w, r, fileStorePath, token)
+		return
+	}
+	if r.Method == "GET" && a.Get("policy") != "" {
+		servePostPolicy(w, r, fileStorePath, a)
+		return
+	}
+	if isVariantRequest(a) {
+		serveThumbnail(w, r, fileStorePath, a)
+		return
+	}
+	if !checkTombstone(w, fileStorePath) {
+		return
+	}
+	if a.Get("meta") != "" {
+		serveMetadata(w, r, fileStorePath)
+		return
+	}
+	if isWholeDownload(r) {
+		defer func() {
+			if rec.status < 400 {
+				countDownload(fileStorePath, time.Now())
 			}
+		}()
+	}
 
-			w.Header().Set("Location", url.String())
-			w.WriteHeader(http.StatusFound) // better known as 302
+	// Some features need to know how the object was stored
+	var info minio.ObjectInfo
+	statted := false
+	if encryptionKey != nil || conf.CompressText || conf.DetectOMEMO {
+		info, err = storageStat(context.Background(), fileStorePath)
+		statted = err == nil
+	}
+
+	proxy := storagePolicyFor(r, fileStorePath).proxy
+	if !proxy && statted && isStoredEncrypted(info) {
+		// S3 only has ciphertext, so we have to sit in between for these
+		proxy = true
+	}
+
+	debugNote(r, "storage: stat %v, proxy %v", statted, proxy)
+	if proxy {
+		obj, err := storageGet(context.Background(), fileStorePath)
+		if err != nil && isBackendFailure(err) && serveCached(w, r, fileStorePath, a) {
+			return
+		} else if err != nil {
+			log.Println("Storage error:", err)
+			httpError(w, storageErrorClass(err), "Storage error", 502)
+			return
+		}
+		addContentHeaders(w.Header(), fileStorePath)
+		if statted && isStoredOpaque(info) {
+			setOpaqueHeaders(w.Header())
+		}
+		forceDownload(w.Header(), fileStorePath, a)
+		if objInfo, err := obj.Stat(); err == nil {
+			addDigestHeaders(w, r, fileStorePath, objInfo)
+		}
+		if (conf.CompressText || encryptionKey != nil) && serveEncoded(w, r, fileStorePath, obj) {
+			return
+		}
+		// Content-Length for HEAD?
+		if r.Method == "GET" {
+			http.ServeContent(w, r, fileStorePath, time.Now(), obj)
 		}
-	} else if r.Method == "OPTIONS" {
-		w.Header().Set("Allow", ALLOWED_METHODS)
-		return
 	} else {
-		log.Println("Invalid method", r.Method)
-		http.Error(w, "405 Method Not Allowed", 405)
+		ch := make(http.Header)
+		addContentHeaders(ch, fileStorePath)
+		if statted && isStoredOpaque(info) {
+			setOpaqueHeaders(ch)
+		}
+		forceDownload(ch, fileStorePath, a)
+		uv := make(url.Values)
+		for k, v := range ch {
+			uv.Set("response-"+strings.ToLower(k), v[0])
+		}
+		if statted && isStoredCompressed(info) {
+			// S3 returns the stored Content-Encoding too, but be explicit.
+			uv.Set("response-content-encoding", "gzip")
+		}
+
+		// NOTE: This is an offline operation, using just our credentials, so it'll work for any URL,
+		// it's up to the S3 backend to 404 if the file isn't there.
+		url, err := storagePresign(context.Background(), fileStorePath, 24*time.Hour, uv)
+		if err != nil {
+			log.Println("Storage error:", err)
+			httpError(w, storageErrorClass(err), "Storage error", 502)
+			return
+		}
+
+		w.Header().Set("Location", url.String())
+		w.WriteHeader(http.StatusFound) // better known as 302
+	}
+}
+
+func handleOptions(w http.ResponseWriter, r *http.Request, f *fileRequest) {
+	w.Header().Set("Allow", allowedMethods())
+}
+
+/*
+ * DELETE with a link from the Link header of the upload response retracts
+ * the file
+ */
+func handleDelete(w http.ResponseWriter, r *http.Request, f *fileRequest) {
+	if !conf.DeleteLinks {
+		handleBadMethod(w, r, f)
 		return
 	}
+	if f.args.Get("d") == "" || !verifyDelete(f.path, f.args, time.Now()) {
+		httpError(w, "invalid_mac", "403 Forbidden", 403)
+		return
+	}
+	err := removeObject(r.Context(), "retract", "delete link "+r.RemoteAddr, "retracted by uploader", f.path)
+	if class := storageErrorClass(err); class == "not_found" {
+		httpError(w, class, "404 Not Found", 404)
+		return
+	} else if err != nil {
+		log.Println("Removing object failed:", err)
+		httpError(w, class, "Storage error", 502)
+		return
+	}
+	log.Println("Retracted", f.path)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func readConfig(configfilename string, conf *Config) error {
-	log.Println("Reading configuration ...")
+func handleBadMethod(w http.ResponseWriter, r *http.Request, f *fileRequest) {
+	log.Println("Invalid method", r.Method)
+	httpError(w, "method_not_allowed", "405 Method Not Allowed", 405)
+}
+
+/*
+ * Whether a GET/HEAD in SignedDownloads mode is authorized by a download
+ * signature. The upload MAC isn't enough: upload URLs end up in logs.
+ */
+func downloadAuthorized(r *http.Request, fileStorePath string, a url.Values) bool {
+	if secureLinkRequest(a) {
+		return verifySecureLink(r, a, time.Now())
+	}
+	if a.Get("d") == "" {
+		logSampled("missing_mac", "Error: No download MAC attached to URL.")
+		securityEvent("missing_mac")
+		return false
+	}
+	return verifyDownload(fileStorePath, a, time.Now())
+}
+
+func signedDownloadURL(fileStorePath string) string {
+	u := url.URL{Path: "/" + conf.UploadSubDir + fileStorePath}
+	u.RawQuery = downloadQuery(fileStorePath, time.Now()).Encode()
+	return u.String()
+}
+
+func signedDeleteURL(fileStorePath string) string {
+	u := url.URL{Path: "/" + conf.UploadSubDir + fileStorePath}
+	u.RawQuery = deleteQuery(fileStorePath, time.Now()).Encode()
+	return u.String()
+}
 
+func setConfigDefaults(conf *Config) {
 	conf.S3TLS = true
+	conf.ListenNetwork = "tcp"
+	conf.SocketMode = "0660"
+	conf.ACMECacheDir = "acme"
+	conf.LegacyS3TLS = true
+	conf.CacheSize = 1 << 30
+	conf.S3ConnRefresh = 5 * time.Minute
+	conf.S3Timeout = 10 * time.Second
+	conf.UploadShare = 0.5
+	conf.HookTimeout = 10 * time.Second
+	conf.MaintenanceMessage = "Uploads are paused for maintenance, please try again later."
+	conf.IntegrityCheckSample = 100
+	conf.RobotsTxt = "User-agent: *\nDisallow: /\n"
+	conf.NoIndex = true
+	conf.DownloadFlushInterval = 30 * time.Second
+	conf.MetricsPushInterval = time.Minute
+	conf.MetricsPushJob = "prosody_filer"
+	conf.S3TransferTimeout = time.Minute
+	conf.S3MinThroughput = 64 << 10
+	conf.CacheMaxFileSize = 16 << 20
+	conf.Scheme = "v1"
+	conf.ThumbnailMaxWidth = 1024
+	conf.UploadSessionTTL = time.Hour
+	conf.PartSize = 16 << 20
+	conf.MultipartThreshold = 16 << 20
+	conf.MultipartMaxAge = 7 * 24 * time.Hour
+	conf.LogSampleBurst = 10
+	conf.PasswordAttempts = 10
+	conf.DebugSampleRate = 1
+	conf.MaxMetricsTenants = 50
+	conf.ShutdownTimeout = time.Minute
+	conf.HealthCheckInterval = 30 * time.Second
+	conf.AlertInterval = time.Minute
+	conf.AlertUsageInterval = time.Hour
+	conf.AlertSMTPServer = "localhost:25"
+	conf.ComponentServer = "localhost:5347"
+	conf.HealthCheckKey = ".health"
+	conf.BreakerThreshold = 5
+	conf.BreakerCooldown = 30 * time.Second
+}
 
+/*
+ * Reads the configuration file (or the environment) into conf, with the
+ * defaults for what it doesn't set. Used for the initial read and reloads.
+ */
+func loadConfig(configfilename string, conf *Config) error {
+	setConfigDefaults(conf)
 	configdata, err := ioutil.ReadFile(configfilename)
-	if err != nil {
-		log.Fatal("Configuration file config.toml cannot be read:", err, "...Exiting.")
-		return err
+	if os.IsNotExist(err) && bootstrapAvailable() {
+		log.Println("No configuration file, using FILER_* environment variables")
+		if err := bootstrapFromEnv(conf); err != nil {
+			return fmt.Errorf("Bootstrap from environment failed: %v", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("Configuration file config.toml cannot be read: %v", err)
+	} else if _, err := toml.Decode(string(configdata), conf); err != nil {
+		return fmt.Errorf("Config file config.toml is invalid: %v", err)
+	}
+	if conf.AuthScheme != "" {
+		conf.Scheme = conf.AuthScheme
+	}
+
+	for env, field := range secretFields(conf) {
+		if value, has, err := readSecretFile(env); err != nil {
+			return err
+		} else if has {
+			*field = value
+		}
+	}
+	return nil
+}
+
+/*
+ * Docker/Kubernetes style secrets: files named by *_FILE variables
+ */
+func secretFields(conf *Config) map[string]*string {
+	return map[string]*string{
+		"SECRET_FILE":           &conf.Secret,
+		"PREVIOUS_SECRET_FILE":  &conf.PreviousSecret,
+		"S3_ACCESS_KEY_FILE":    &conf.S3AccessKey,
+		"S3_SECRET_FILE":        &conf.S3Secret,
+		"API_TOKEN_FILE":        &conf.APIToken,
+		"ENCRYPTION_KEY_FILE":   &conf.EncryptionKey,
+		"COMPONENT_SECRET_FILE": &conf.ComponentSecret,
+		"METRICS_TOKEN_FILE":    &conf.MetricsToken,
 	}
+}
 
-	if _, err := toml.Decode(string(configdata), conf); err != nil {
-		log.Fatal("Config file config.toml is invalid:", err)
+func readConfig(configfilename string, conf *Config) error {
+	log.Println("Reading configuration ...")
+
+	if err := loadConfig(configfilename, conf); err != nil {
+		log.Fatal(err)
 		return err
 	}
 
+	if _, ok := macSchemes[conf.Scheme]; !ok {
+		log.Fatal("Unknown signature Scheme: ", conf.Scheme)
+	}
+	for _, network := range []string{conf.ListenNetwork, conf.S3Network} {
+		if network != "" && network != "tcp" && network != "tcp4" && network != "tcp6" {
+			log.Fatal("Unknown network ", network, ", use tcp, tcp4 or tcp6")
+		}
+	}
+	if conf.ShortLinks && conf.MetadataDB == "" {
+		log.Fatal("ShortLinks needs MetadataDB")
+	}
+	for ext, ctype := range conf.MimeTypes {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if err := mime.AddExtensionType(strings.ToLower(ext), ctype); err != nil {
+			log.Fatal("Invalid MimeTypes entry for ", ext, ": ", err)
+		}
+	}
+	tenants := make(map[string]TenantConfig)
+	for domain, t := range conf.Tenants {
+		if t.DownloadHost == "" {
+			log.Fatal("Tenant ", domain, " needs a DownloadHost")
+		}
+		if t.TLSCert != "" && conf.TLSCert == "" && len(conf.ACMEDomains) == 0 {
+			log.Fatal("Tenant certificates need TLSCert or ACMEDomains to be set too")
+		}
+		tenants[strings.ToLower(domain)] = t
+	}
+	conf.Tenants = tenants
+	if (conf.TLSCert == "") != (conf.TLSKey == "") {
+		log.Fatal("TLSCert and TLSKey need to be set together")
+	}
+	if mode, err := strconv.ParseUint(conf.SocketMode, 8, 32); err != nil || mode > 0777 {
+		log.Fatal("Invalid SocketMode ", conf.SocketMode, ", use e.g. \"0660\"")
+	}
+	if len(conf.ACMEDomains) > 0 && conf.TLSCert != "" {
+		log.Fatal("Use either ACMEDomains or TLSCert and TLSKey")
+	}
+	if len(conf.ACMEDomains) > 0 && conf.Chroot != "" && conf.MetadataDB == "" {
+		log.Fatal("ACMEDomains with Chroot needs MetadataDB to keep certificates in")
+	}
+	if conf.HTTPRedirectListenport != "" && conf.TLSCert == "" && len(conf.ACMEDomains) == 0 {
+		log.Fatal("HTTPRedirectListenport needs TLSCert and TLSKey or ACMEDomains")
+	}
+	if conf.Tombstones && conf.MetadataDB == "" {
+		log.Fatal("Tombstones needs MetadataDB")
+	}
+	if conf.FilePasswords && conf.MetadataDB == "" {
+		log.Fatal("FilePasswords needs MetadataDB")
+	}
+	if conf.DownloadTracking && conf.MetadataDB == "" {
+		log.Fatal("DownloadTracking needs MetadataDB")
+	}
+	if conf.SkipIdenticalUploads && conf.MetadataDB == "" {
+		log.Fatal("SkipIdenticalUploads needs MetadataDB")
+	}
+	if conf.UploadShare <= 0 || conf.UploadShare > 1 {
+		log.Fatal("UploadShare must be more than 0 and at most 1")
+	}
+	switch conf.CDNProvider {
+	case "", "fastly":
+	case "cloudflare":
+		if conf.CDNZone == "" || conf.CDNToken == "" {
+			log.Fatal("CDNProvider cloudflare needs CDNZone and CDNToken")
+		}
+	case "webhook":
+		if conf.CDNWebhook == "" {
+			log.Fatal("CDNProvider webhook needs CDNWebhook")
+		}
+	default:
+		log.Fatal("Unknown CDNProvider ", conf.CDNProvider)
+	}
+	if conf.CDNProvider != "" && conf.CDNBaseURL == "" {
+		log.Fatal("CDNProvider needs CDNBaseURL")
+	}
+	if conf.AlertErrorRate < 0 || conf.AlertErrorRate > 1 {
+		log.Fatal("AlertErrorRate must be between 0 and 1")
+	}
+	if len(conf.AlertEmail) > 0 && conf.AlertEmailFrom == "" {
+		log.Fatal("AlertEmail needs AlertEmailFrom")
+	}
+	if conf.PartSize < minPartSize || conf.PartSize > maxPartSize {
+		log.Fatal("PartSize must be between 5 MiB and 5 GiB")
+	}
+	if conf.MultipartThreshold < 1 || conf.MultipartThreshold > maxPartSize {
+		log.Fatal("MultipartThreshold must be between 1 byte and 5 GiB")
+	}
+	if conf.ManageLifecycle && (conf.StorageType == "local" || conf.EmbeddedStorage != "") {
+		log.Fatal("ManageLifecycle needs S3 storage")
+	}
+	if (conf.UserQuota > 0 || len(conf.UserQuotas) > 0) && conf.MetadataDB == "" {
+		log.Fatal("UserQuota needs MetadataDB")
+	}
+	if (conf.UserQuota > 0 || len(conf.UserQuotas) > 0) && conf.PresignedPost {
+		// Those uploads go straight to S3, so they'd never be counted
+		log.Fatal("UserQuota can't be used with PresignedPost")
+	}
+	if conf.ComponentJID != "" && (conf.ComponentSecret == "" || conf.ComponentURL == "") {
+		log.Fatal("ComponentJID needs ComponentSecret and ComponentURL")
+	}
+	if conf.RequireUploadSessions && (conf.MetadataDB == "" || conf.APIToken == "") {
+		log.Fatal("RequireUploadSessions needs MetadataDB and APIToken")
+	}
+	if conf.PreviousSecret != "" {
+		if conf.PreviousScheme == "" {
+			conf.PreviousScheme = conf.Scheme
+		}
+		if _, ok := macSchemes[conf.PreviousScheme]; !ok {
+			log.Fatal("Unknown signature PreviousScheme: ", conf.PreviousScheme)
+		}
+		if conf.PreviousUntil.IsZero() {
+			log.Fatal("PreviousSecret requires PreviousUntil to be set")
+		}
+	}
+
+	if conf.EmbeddedStorage != "" {
+		// Presigned URLs would point at our loopback-only store
+		conf.ProxyMode = true
+	}
+	switch conf.StorageType {
+	case "", "s3":
+	case "local":
+		if conf.StorageRoot == "" {
+			log.Fatal("StorageType local needs StorageRoot")
+		}
+		if conflicts := localStorageConflicts(); len(conflicts) > 0 {
+			log.Fatal("Not available with StorageType local: ", strings.Join(conflicts, ", "))
+		}
+		// Nothing to presign, nor multipart uploads to clean up
+		conf.ProxyMode = true
+		conf.MultipartMaxAge = 0
+	default:
+		log.Fatal("Unknown StorageType ", conf.StorageType)
+	}
+
+	if err := loadEncryptionKey(); err != nil {
+		log.Fatal(err)
+	}
+	checkStoragePolicies()
+	if err := checkFIPS(); err != nil {
+		log.Fatal(err)
+	}
+
 	// Support standard AWS credential env variables as well (will override whatever may have been in the config!)
 	if key, has := os.LookupEnv("AWS_ACCESS_KEY_ID"); has {
 		log.Println("Loading AWS credentials from evironment instead of config")
@@ -205,27 +1145,77 @@ func readConfig(configfilename string, conf *Config) error {
 	if key, has := os.LookupEnv("AWS_SECRET_ACCESS_KEY"); has {
 		conf.S3Secret = key
 	}
+	for env, field := range map[string]*string{
+		"AWS_ACCESS_KEY_ID_FILE":     &conf.S3AccessKey,
+		"AWS_SECRET_ACCESS_KEY_FILE": &conf.S3Secret,
+	} {
+		if value, has, err := readSecretFile(env); err != nil {
+			log.Fatal(err)
+		} else if has {
+			*field = value
+		}
+	}
 	return nil
 }
 
+/*
+ * Reads the file named in environment variable env, without the trailing
+ * newline most editors and `echo` add
+ */
+func readSecretFile(env string) (string, bool, error) {
+	name, has := os.LookupEnv(env)
+	if !has || name == "" {
+		return "", false, nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: %v", env, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
 func s3Login() {
 	var err error
 	s3Client, err = minio.New(conf.S3Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(conf.S3AccessKey, conf.S3Secret, ""),
-		Secure: conf.S3TLS,
+		Creds:     credentials.NewStaticV4(conf.S3AccessKey, conf.S3Secret, ""),
+		Secure:    conf.S3TLS,
+		Transport: storageTransport(conf.S3TLS),
 	})
 	if err != nil {
 		log.Fatalln(err)
 	}
-	exists, err := s3Client.BucketExists(context.Background(), conf.S3Bucket)
+	s3Core = minio.Core{Client: s3Client}
+	backend = s3Backend{s3Client}
+	if err := checkBucket(); err != nil {
+		// Don't crash-loop during a provider outage, serve 503s and retry
+		log.Println("Storage unavailable, retrying in the background:", err)
+		storageUnavailable.Store(true)
+		go retryStorage()
+	}
+}
+
+func storageLogin() error {
+	if conf.StorageType == "local" {
+		return localLogin()
+	}
+	s3Login()
+	log.Println("S3 bucket found.")
+	return nil
+}
+
+func checkBucket() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	exists, err := s3Client.BucketExists(ctx, conf.S3Bucket)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 	if !exists {
 		// Buggy example: Scaleway, appears to always report non-existent.
 		// But hey at least we've verified that the credentials work which is actually the main thing I want to check here.
 		log.Println("WARNING: Bucket does not exist (or S3 service is buggy): " + conf.S3Bucket)
 	}
+	return nil
 }
 
 /*
@@ -236,27 +1226,155 @@ func main() {
 	 * Read startup arguments
 	 */
 	var argConfigFile = flag.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	var argSignDownload = flag.String("sign-download", "", "Print a signed download URL for this file path (relative to UploadSubDir) and exit.")
+	var argSignDelete = flag.String("sign-delete", "", "Print a signed delete URL for this file path (relative to UploadSubDir) and exit.")
+	var argSignThumbnail = flag.String("sign-thumbnail", "", "Print a signed thumbnail URL for this file path (relative to UploadSubDir) and exit.")
+	var argWidth = flag.Int("width", 320, "Thumbnail width for -sign-thumbnail.")
+	var argSelftest = flag.String("selftest", "", "Upload, download and delete a test file on the Filer running at this URL (e.g. https://upload.example.com) and exit.")
+	var argDoctor = flag.Bool("doctor", false, "Check the configuration for common problems and exit.")
+	var argProsodyConfig = flag.String("prosody-config", "", "Prosody config file to compare the secret and base URL with for -doctor.")
+	var argService = flag.String("service", "", "Windows only: \"install\" or \"uninstall\" the service, or \"run\" it in the console.")
 	flag.Parse()
 
+	if *argService == "install" || *argService == "uninstall" {
+		if err := controlService(*argService, *argConfigFile); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	/*
 	 * Read config file
 	 */
-	err := readConfig(*argConfigFile, &conf)
+	configFile = *argConfigFile
+	err := readConfig(configFile, &conf)
 	if err != nil {
 		log.Println("There was an error while reading the configuration file:", err)
 	}
 
+	if *argDoctor {
+		if !runDoctor(*argProsodyConfig) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *argSelftest != "" {
+		if !runSelftest(*argSelftest) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *argSignDownload != "" {
+		fmt.Println(signedDownloadURL(*argSignDownload))
+		return
+	}
+	if *argSignDelete != "" {
+		fmt.Println(signedDeleteURL(*argSignDelete))
+		return
+	}
+	if *argSignThumbnail != "" {
+		u := url.URL{Path: "/" + conf.UploadSubDir + *argSignThumbnail}
+		u.RawQuery = thumbnailQuery(*argSignThumbnail, *argWidth).Encode()
+		fmt.Println(u.String())
+		return
+	}
+
+	if err := runService(runServer, *argService == "run"); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+/*
+ * Connects to the backend and serves until we're told to stop
+ */
+func runServer() error {
 	log.Println("Starting Prosody-Filer-S3...")
-	s3Login()
-	log.Println("S3 bucket found.")
+	if err := startEmbeddedStorage(); err != nil {
+		return err
+	}
+	if err := storageLogin(); err != nil {
+		return err
+	}
+	legacyLogin()
+	openCache()
+
+	openMetadataDB()
+	initUsage()
+	openAuditLog()
+	openAuditStream()
+	if err := loadUploadPolicy(); err != nil {
+		return err
+	}
+	if metaDB != nil {
+		go expireSessions()
+	}
+	if conf.DownloadTracking {
+		go runDownloadFlusher()
+	}
+	go runIntegrityChecks()
+	setMaintenance(conf.Maintenance)
+	go watchMaintenanceSignal()
+	prepareReload()
+	go watchReloadSignal()
+	serveMetrics()
+	go runMetricsPusher()
+	go runRetention()
+	if err := manageLifecycle(context.Background()); err != nil {
+		log.Println("Can't set bucket lifecycle, expiring files ourselves:", err)
+	}
+	go runExpiry()
+	go runHealthProber()
+	go runAlerter()
+	go runComponent()
+	go cleanupStaleMultipart()
+	go refreshConnections()
 
 	/*
 	 * Start HTTP server
 	 */
 	http.HandleFunc("/"+conf.UploadSubDir, handleRequest)
-	log.Printf("Server started on %s. Waiting for requests.\n", conf.Listenport)
-	err = http.ListenAndServe(conf.Listenport, nil)
+	registerAPI(http.DefaultServeMux)
+	if conf.RobotsTxt != "" {
+		http.HandleFunc("/robots.txt", handleRobots)
+	}
+	http.HandleFunc("/.well-known/prosody-filer", handleCapabilities)
+	http.HandleFunc("/capabilities", handleCapabilities)
+	http.HandleFunc("/raw/", handleDownloadVariant)
+	http.HandleFunc("/view/", handleDownloadVariant)
+	http.HandleFunc("/ready", handleReady)
+	if conf.MetricsToken != "" {
+		http.HandleFunc("/metrics", handleMetrics)
+	}
+	if conf.ShortLinks {
+		http.HandleFunc("/d/", handleShortLink)
+	}
+	if len(conf.WebUploadUsers) > 0 {
+		http.HandleFunc("/share/", handleWebUpload)
+	}
+	tlsConfig, err := serverTLSConfig()
 	if err != nil {
-		log.Fatalln(err)
+		return err
+	}
+	lns, err := listen(conf.Listenport)
+	if err != nil {
+		return err
+	}
+	if err := serveHTTPRedirect(); err != nil {
+		return err
+	}
+	if err := dropPrivileges(); err != nil {
+		return err
+	}
+	if err := applySandbox(); err != nil {
+		return err
+	}
+	for _, ln := range lns {
+		log.Printf("Server started on %s. Waiting for requests.\n", ln.Addr())
+	}
+	err = serveUntilSignal(&http.Server{Handler: tenantRouter(http.DefaultServeMux), TLSConfig: tlsConfig}, lns)
+	flushDownloads()
+	if conf.MetricsPushURL != "" || conf.MetricsRemoteWriteURL != "" {
+		pushMetrics()
 	}
+	return err
 }
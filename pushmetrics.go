@@ -0,0 +1,186 @@
+package main
+
+/*
+ * Pushing metrics, for instances Prometheus can't scrape: short-lived ones,
+ * or ones behind a firewall. Every MetricsPushInterval everything that
+ * /metrics would show is sent to a Pushgateway (MetricsPushURL) and/or a
+ * Prometheus remote-write receiver (MetricsRemoteWriteURL), and once more
+ * on shutdown. Credentials can go in the URLs' userinfo.
+ */
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func pushInstance() string {
+	if conf.MetricsPushInstance != "" {
+		return conf.MetricsPushInstance
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+func runMetricsPusher() {
+	if conf.MetricsPushURL == "" && conf.MetricsRemoteWriteURL == "" {
+		return
+	}
+	log.Printf("Pushing metrics every %v", conf.MetricsPushInterval)
+	for range time.Tick(conf.MetricsPushInterval) {
+		pushMetrics()
+	}
+}
+
+func pushMetrics() {
+	if conf.MetricsPushURL != "" {
+		err := push.New(conf.MetricsPushURL, conf.MetricsPushJob).
+			Gatherer(prometheus.DefaultGatherer).
+			Grouping("instance", pushInstance()).
+			Push()
+		if err != nil {
+			log.Println("Can't push metrics to Pushgateway:", err)
+		}
+	}
+	if conf.MetricsRemoteWriteURL != "" {
+		if err := remoteWrite(conf.MetricsRemoteWriteURL); err != nil {
+			log.Println("Can't send metrics to remote-write receiver:", err)
+		}
+	}
+}
+
+type remoteLabel struct{ name, value string }
+
+type remoteSeries struct {
+	labels []remoteLabel
+	value  float64
+}
+
+/*
+ * Flattens metric families into plain series the way Prometheus would
+ * after scraping them: histograms become _bucket, _sum and _count.
+ */
+func remoteSeriesOf(families []*dto.MetricFamily, extra []remoteLabel) []remoteSeries {
+	var series []remoteSeries
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			labels := append([]remoteLabel{}, extra...)
+			for _, lp := range m.Label {
+				labels = append(labels, remoteLabel{lp.GetName(), lp.GetValue()})
+			}
+			add := func(suffix string, value float64, more ...remoteLabel) {
+				l := append([]remoteLabel{{"__name__", mf.GetName() + suffix}}, labels...)
+				l = append(l, more...)
+				sort.Slice(l, func(i, j int) bool { return l[i].name < l[j].name })
+				series = append(series, remoteSeries{l, value})
+			}
+			switch {
+			case m.Counter != nil:
+				add("", m.Counter.GetValue())
+			case m.Gauge != nil:
+				add("", m.Gauge.GetValue())
+			case m.Untyped != nil:
+				add("", m.Untyped.GetValue())
+			case m.Histogram != nil:
+				for _, b := range m.Histogram.Bucket {
+					add("_bucket", float64(b.GetCumulativeCount()), remoteLabel{"le", formatFloat(b.GetUpperBound())})
+				}
+				add("_bucket", float64(m.Histogram.GetSampleCount()), remoteLabel{"le", "+Inf"})
+				add("_sum", m.Histogram.GetSampleSum())
+				add("_count", float64(m.Histogram.GetSampleCount()))
+			case m.Summary != nil:
+				for _, q := range m.Summary.Quantile {
+					add("", q.GetValue(), remoteLabel{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", m.Summary.GetSampleSum())
+				add("_count", float64(m.Summary.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+/*
+ * The remote-write WriteRequest protobuf. Simple enough to write out by
+ * hand rather than pull in Prometheus' generated code:
+ *   WriteRequest { repeated TimeSeries timeseries = 1; }
+ *   TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+ *   Label        { string name = 1; string value = 2; }
+ *   Sample       { double value = 1; int64 timestamp = 2; }
+ */
+func encodeWriteRequest(series []remoteSeries, ts time.Time) []byte {
+	var req []byte
+	for _, s := range series {
+		var msg []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.value)
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendBytes(msg, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(ts.UnixMilli()))
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, sample)
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, msg)
+	}
+	return req
+}
+
+func remoteWrite(url string) error {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return err
+	}
+	series := remoteSeriesOf(families, []remoteLabel{{"instance", pushInstance()}, {"job", conf.MetricsPushJob}})
+	body := snappy.Encode(nil, encodeWriteRequest(series, time.Now()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.MetricsPushInterval)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+/*
+ * Per-user storage quotas. The bytes each user (the first path component of
+ * their uploads) has stored are kept in MetadataDB, updated as files are
+ * stored and removed. Uploads that would take a user over UserQuota (or
+ * their entry in UserQuotas) get 507. The first time quotas are enabled the
+ * usage is counted from a listing of the bucket, in the background.
+ *
+ * The check happens before the upload, so concurrent uploads can overshoot
+ * the quota by a little.
+ */
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	usageBucket      = "usage"       // user -> bytes stored
+	usageFilesBucket = "usage_files" // key -> bytes counted for it
+)
+
+// Serializes read-modify-write of the totals
+var usageMu sync.Mutex
+
+func quotasEnabled() bool {
+	s := settings()
+	return metaDB != nil && (s.UserQuota > 0 || len(s.UserQuotas) > 0)
+}
+
+func quotaFor(user string) int64 {
+	s := settings()
+	if q, ok := s.UserQuotas[user]; ok {
+		return q
+	}
+	return s.UserQuota
+}
+
+func userUsage(user string) int64 {
+	var used int64
+	metaDB.View(func(tx *bolt.Tx) error {
+		metaGet(tx, usageBucket, user, &used)
+		return nil
+	})
+	return used
+}
+
+/*
+ * Used in checkUpload
+ */
+func checkQuota(user string, size int64) *uploadRejection {
+	if !quotasEnabled() {
+		return nil
+	}
+	if quota := quotaFor(user); quota > 0 && userUsage(user)+size > quota {
+		return &uploadRejection{507, "quota", "Insufficient Storage"}
+	}
+	return nil
+}
+
+/*
+ * Counts a stored file against its user, replacing what was counted for an
+ * earlier file at the same key
+ */
+func recordUsage(key string, size int64) {
+	if !quotasEnabled() {
+		return
+	}
+	if err := adjustUsage(key, size, true); err != nil {
+		log.Println("Failed to record usage:", err)
+	}
+}
+
+/*
+ * Stops counting a removed file
+ */
+func forgetUsage(key string) {
+	if !quotasEnabled() {
+		return
+	}
+	if err := adjustUsage(key, 0, false); err != nil {
+		log.Println("Failed to record usage:", err)
+	}
+}
+
+func adjustUsage(key string, size int64, stored bool) error {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	return metaDB.Update(func(tx *bolt.Tx) error {
+		var old, used int64
+		metaGet(tx, usageFilesBucket, key, &old)
+		user := userOf(key)
+		metaGet(tx, usageBucket, user, &used)
+		used += size - old
+		if used < 0 {
+			used = 0
+		}
+		if err := metaPut(tx, usageBucket, user, used); err != nil {
+			return err
+		}
+		if stored {
+			return metaPut(tx, usageFilesBucket, key, size)
+		}
+		return metaDelete(tx, usageFilesBucket, key)
+	})
+}
+
+/*
+ * Counts what's in the bucket if usage has never been recorded
+ */
+func initUsage() {
+	if !quotasEnabled() {
+		return
+	}
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(usageFilesBucket)) != nil {
+			return errUsageCounted
+		}
+		_, err := tx.CreateBucket([]byte(usageFilesBucket))
+		return err
+	})
+	if err == nil {
+		go countUsage()
+	} else if err != errUsageCounted {
+		log.Println("Can't set up usage accounting:", err)
+	}
+}
+
+var errUsageCounted = errors.New("usage already counted")
+
+func countUsage() {
+	log.Println("Counting storage used per user for quotas ...")
+	n := 0
+	for obj := range storageList(context.Background(), "") {
+		if obj.Err != nil {
+			log.Println("Counting usage failed, quotas only cover new uploads:", obj.Err)
+			return
+		}
+		if isReservedKey(obj.Key) {
+			continue
+		}
+		if err := adjustUsage(obj.Key, obj.Size, true); err != nil {
+			log.Println("Counting usage failed:", err)
+			return
+		}
+		n++
+	}
+	log.Println("Counted", n, "files for quotas")
+}
+
+/*
+ * GET /api/usage?user=<user>
+ */
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	if !quotasEnabled() {
+		http.Error(w, "501 Needs UserQuota and MetadataDB", 501)
+		return
+	}
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		http.Error(w, "400 Need user", 400)
+		return
+	}
+	writeJSON(w, 200, map[string]interface{}{"user": user, "bytes": userUsage(user), "quota": quotaFor(user)})
+}
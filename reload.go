@@ -0,0 +1,192 @@
+package main
+
+/*
+ * Reloading config.toml on SIGHUP, for the settings that can change without
+ * interrupting uploads: Secret and PreviousSecret (rotate by moving the old
+ * secret to PreviousSecret, with a PreviousUntil), the quotas, RetentionDays
+ * and logging. Everything else still needs a restart. If the file can't be
+ * read or doesn't check out, we keep running with what we had.
+ *
+ * Requests read these settings while a reload may be changing them, so they
+ * take a snapshot with settings() rather than reading conf.
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The -config file, for reloading
+var configFile string
+
+var (
+	// Why reloading can't work, if it can't
+	reloadUnavailable error
+	// Directories of the config and secret files, for the sandbox
+	reloadDirs []string
+)
+
+/*
+ * The settings a reload can change
+ */
+type liveSettings struct {
+	Secret          string
+	PreviousSecret  string
+	PreviousScheme  string
+	PreviousUntil   time.Time
+	UserQuota       int64
+	UserQuotas      map[string]int64
+	RetentionDays   int
+	QuietLogs       bool
+	LogSampleBurst  int
+	Debug           bool
+	DebugSampleRate float64
+}
+
+// Held for writing while a reload updates them in conf
+var reloadMu sync.RWMutex
+
+func settings() liveSettings {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return liveSettings{
+		Secret:          conf.Secret,
+		PreviousSecret:  conf.PreviousSecret,
+		PreviousScheme:  conf.PreviousScheme,
+		PreviousUntil:   conf.PreviousUntil,
+		UserQuota:       conf.UserQuota,
+		UserQuotas:      conf.UserQuotas,
+		RetentionDays:   conf.RetentionDays,
+		QuietLogs:       conf.QuietLogs,
+		LogSampleBurst:  conf.LogSampleBurst,
+		Debug:           conf.Debug,
+		DebugSampleRate: conf.DebugSampleRate,
+	}
+}
+
+/*
+ * After Chroot, the config file and the *_FILE secrets are only there at
+ * their paths inside it, and with Sandbox only readable if Landlock lets us.
+ * Works out both while we still see the whole file system. Reloading is off
+ * if one of them is outside the Chroot.
+ */
+func prepareReload() {
+	paths := map[string]string{"": configFile}
+	for env := range secretFields(&conf) {
+		if name := os.Getenv(env); name != "" {
+			paths[env] = name
+		}
+	}
+	reloadDirs = nil
+	for env, name := range paths {
+		path, err := filepath.Abs(name)
+		if err == nil && conf.Chroot != "" {
+			path, err = inChroot(path)
+		}
+		if err != nil {
+			reloadUnavailable = err
+			log.Println("Reloading on SIGHUP is off:", err)
+			return
+		}
+		if env == "" {
+			configFile = path
+		} else {
+			os.Setenv(env, path)
+		}
+		reloadDirs = append(reloadDirs, filepath.Dir(path))
+	}
+}
+
+/*
+ * Where the file is after the chroot
+ */
+func inChroot(path string) (string, error) {
+	root, err := filepath.Abs(conf.Chroot)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside Chroot %s", path, conf.Chroot)
+	}
+	return filepath.Join(string(filepath.Separator), rel), nil
+}
+
+func watchReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloadConfig(configFile); err != nil {
+			log.Println("Not reloading configuration:", err)
+		}
+	}
+}
+
+func reloadConfig(filename string) error {
+	if reloadUnavailable != nil {
+		return reloadUnavailable
+	}
+	var fresh Config
+	if err := loadConfig(filename, &fresh); err != nil {
+		return err
+	}
+	if fresh.Secret == "" {
+		return errors.New("no Secret")
+	}
+	if fresh.PreviousSecret != "" {
+		if fresh.PreviousScheme == "" {
+			fresh.PreviousScheme = conf.Scheme
+		}
+		if _, ok := macSchemes[fresh.PreviousScheme]; !ok {
+			return fmt.Errorf("unknown signature PreviousScheme %s", fresh.PreviousScheme)
+		}
+		if fresh.PreviousUntil.IsZero() {
+			return errors.New("PreviousSecret requires PreviousUntil to be set")
+		}
+	}
+	if conf.RequireFIPS && (len(fresh.Secret) < fipsMinKeyLength || (fresh.PreviousSecret != "" && len(fresh.PreviousSecret) < fipsMinKeyLength)) {
+		return fmt.Errorf("secrets must be at least %d bytes in FIPS mode", fipsMinKeyLength)
+	}
+	if (fresh.UserQuota > 0 || len(fresh.UserQuotas) > 0) && metaDB == nil {
+		return errors.New("UserQuota needs MetadataDB")
+	}
+	if (fresh.UserQuota > 0 || len(fresh.UserQuotas) > 0) && conf.PresignedPost {
+		return errors.New("UserQuota can't be used with PresignedPost")
+	}
+
+	reloadMu.Lock()
+	retentionChanged := fresh.RetentionDays != conf.RetentionDays
+	conf.Secret = fresh.Secret
+	conf.PreviousSecret = fresh.PreviousSecret
+	conf.PreviousScheme = fresh.PreviousScheme
+	conf.PreviousUntil = fresh.PreviousUntil
+	conf.UserQuota = fresh.UserQuota
+	conf.UserQuotas = fresh.UserQuotas
+	conf.RetentionDays = fresh.RetentionDays
+	conf.QuietLogs = fresh.QuietLogs
+	conf.LogSampleBurst = fresh.LogSampleBurst
+	conf.Debug = fresh.Debug
+	conf.DebugSampleRate = fresh.DebugSampleRate
+	reloadMu.Unlock()
+	log.Println("Reloaded configuration from", filename)
+
+	// Count usage if quotas were just turned on
+	initUsage()
+	if retentionChanged && conf.ManageLifecycle {
+		if err := manageLifecycle(context.Background()); err != nil {
+			// runExpiry takes over
+			lifecycleManaged.Store(false)
+			log.Println("Failed to update lifecycle rule:", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+/*
+ * Dispatch of file requests (everything under UploadSubDir): each method
+ * has its own handler, wrapped in the checks that apply to it, routed by
+ * method patterns. The patterns only look at the method; handleRequest has
+ * already worked out the key from the path.
+ */
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+)
+
+/*
+ * What the method handlers get to know about a file request
+ */
+type fileRequest struct {
+	path string // fileStorePath, the key in the bucket
+	args url.Values
+	rec  *responseRecorder
+}
+
+type fileRequestKey struct{}
+
+type fileHandler func(w http.ResponseWriter, r *http.Request, f *fileRequest)
+
+type fileMiddleware func(next fileHandler) fileHandler
+
+var fileRoutes = http.NewServeMux()
+
+func init() {
+	// "GET" patterns match HEAD as well
+	fileRoutes.Handle("PUT /", pipeline(handlePut, notReserved, unlessStorageDown, notInMaintenance, admittingUploads))
+	fileRoutes.Handle("POST /", pipeline(handlePost, notReserved, unlessStorageDown, notInMaintenance))
+	fileRoutes.Handle("GET /", pipeline(handleGet, notReserved, noIndex, signedDownload, passwordProtected, unlessStorageDown, notInMaintenance, admittingDownloads))
+	fileRoutes.Handle("DELETE /", pipeline(handleDelete, notReserved, unlessStorageDown))
+	fileRoutes.Handle("OPTIONS /", pipeline(handleOptions, notReserved))
+	fileRoutes.Handle("/", pipeline(handleBadMethod, notReserved, unlessStorageDown))
+}
+
+/*
+ * Only the method picks the route, so the mux gets to see a stand-in for
+ * the request: it would redirect paths it doesn't consider clean, like the
+ * double slashes some upload URLs have.
+ */
+func routeFile(w http.ResponseWriter, r *http.Request) {
+	h, _ := fileRoutes.Handler(&http.Request{Method: r.Method, URL: &url.URL{Path: "/"}})
+	h.ServeHTTP(w, r)
+}
+
+/*
+ * The handler with its middleware, outermost first
+ */
+func pipeline(h fileHandler, mw ...fileMiddleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h(w, r, r.Context().Value(fileRequestKey{}).(*fileRequest))
+	})
+}
+
+/*
+ * Middleware that only checks something, answering the request itself if
+ * that fails
+ */
+func check(ok func(w http.ResponseWriter, r *http.Request, f *fileRequest) bool) fileMiddleware {
+	return func(next fileHandler) fileHandler {
+		return func(w http.ResponseWriter, r *http.Request, f *fileRequest) {
+			if ok(w, r, f) {
+				next(w, r, f)
+			}
+		}
+	}
+}
+
+var notReserved = check(func(w http.ResponseWriter, r *http.Request, f *fileRequest) bool {
+	if isReservedKey(f.path) {
+		httpError(w, "not_found", "404 Not Found", 404)
+		return false
+	}
+	return true
+})
+
+var noIndex = check(func(w http.ResponseWriter, r *http.Request, f *fileRequest) bool {
+	if conf.NoIndex {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+	return true
+})
+
+/*
+ * Downloads need their signature checked before anything else is done for
+ * them, like hashing the password someone tries on a protected file:
+ * thumbnails always, other downloads with SignedDownloads. The upload offset,
+ * progress and POST policy requests check their own.
+ */
+var signedDownload = check(func(w http.ResponseWriter, r *http.Request, f *fileRequest) bool {
+	ok := true
+	switch {
+	case r.Method == "HEAD" && conf.ResumableUploads && r.Header.Get("Upload-Length") != "":
+	case r.Method == "GET" && (validProgressToken(f.args.Get("progress")) || f.args.Get("policy") != ""):
+	case isVariantRequest(f.args):
+		ok = verifyVariant(f.path, f.args)
+	case conf.SignedDownloads:
+		ok = downloadAuthorized(r, f.path, f.args)
+	}
+	if !ok {
+		httpError(w, "invalid_mac", "403 Forbidden", 403)
+	}
+	return ok
+})
+
+var passwordProtected = check(func(w http.ResponseWriter, r *http.Request, f *fileRequest) bool {
+	return passwordAuthorized(w, r, f.path)
+})
+
+/*
+ * Serves from the cache where we can while the backend is down, 503
+ * otherwise
+ */
+var unlessStorageDown = check(func(w http.ResponseWriter, r *http.Request, f *fileRequest) bool {
+	if storageDown() && serveCached(w, r, f.path, f.args) {
+		return false
+	}
+	return checkBreaker(w)
+})
+
+var notInMaintenance = check(func(w http.ResponseWriter, r *http.Request, f *fileRequest) bool {
+	if r.Method != "PUT" && r.Method != "POST" && f.args.Get("policy") == "" {
+		// Downloads go on
+		return true
+	}
+	return checkMaintenance(w)
+})
+
+func admittingUploads(next fileHandler) fileHandler {
+	return func(w http.ResponseWriter, r *http.Request, f *fileRequest) {
+		release, ok := admitUpload(w, r)
+		if !ok {
+			log.Println("Overloaded, turning away upload of", r.ContentLength, "bytes")
+			return
+		}
+		defer release()
+		next(w, r, f)
+	}
+}
+
+func admittingDownloads(next fileHandler) fileHandler {
+	return func(w http.ResponseWriter, r *http.Request, f *fileRequest) {
+		release, ok := admitDownload(w)
+		if !ok {
+			log.Println("Overloaded, turning away download")
+			return
+		}
+		defer release()
+		next(w, r, f)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+/*
+ * Landlock sandboxing: once started, the process can only read the few
+ * system files that networking needs and its config (for reloading), and
+ * write to its own state directories, so even a compromised image decoder
+ * can't read or write anything else on the machine. Kernels without
+ * Landlock are left alone.
+ */
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/landlock-lsm/go-landlock/landlock"
+)
+
+func applySandbox() error {
+	if !conf.Sandbox {
+		return nil
+	}
+	var rw []string
+	for _, f := range []string{conf.MetadataDB, conf.AuditLog} {
+		if f != "" {
+			rw = append(rw, filepath.Dir(f))
+		}
+	}
+	rw = append(rw, conf.SandboxPaths...)
+
+	err := landlock.V5.BestEffort().RestrictPaths(
+		landlock.ROFiles("/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf").IgnoreIfMissing(),
+		landlock.RODirs("/etc/ssl", "/etc/pki", "/usr/share/zoneinfo").IgnoreIfMissing(),
+		landlock.RODirs(reloadDirs...).IgnoreIfMissing(),
+		landlock.RWDirs(rw...),
+	)
+	if err != nil {
+		return err
+	}
+	log.Println("Sandboxed, writable:", rw)
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func applySandbox() error {
+	if conf.Sandbox {
+		return errors.New("Sandbox is only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+/*
+ * nginx secure_link compatibility, so links issued for an nginx frontend
+ * keep working once requests go to the Filer directly. SecureLinkMD5 is the
+ * secure_link_md5 expression from the nginx config, verbatim, e.g.
+ *
+ *   secure_link $arg_md5,$arg_expires;
+ *   secure_link_md5 "$secure_link_expires$uri$remote_addr secret";
+ *
+ * Only the md5/expires argument names from the nginx documentation are
+ * supported, and the variables below.
+ */
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var secureLinkVar = regexp.MustCompile(`\$(\w+)|\$\{(\w+)\}`)
+
+func secureLinkRequest(a url.Values) bool {
+	return conf.SecureLinkMD5 != "" && a.Get("md5") != ""
+}
+
+func secureLinkInput(r *http.Request, expires string) string {
+	return secureLinkVar.ReplaceAllStringFunc(conf.SecureLinkMD5, func(v string) string {
+		name := secureLinkVar.FindStringSubmatch(v)
+		switch name[1] + name[2] {
+		case "secure_link_expires":
+			return expires
+		case "uri":
+			return r.URL.Path
+		case "remote_addr":
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			return host
+		case "host":
+			return r.Host
+		case "request_method":
+			return r.Method
+		}
+		return v
+	})
+}
+
+func verifySecureLink(r *http.Request, a url.Values, now time.Time) bool {
+	expires := a.Get("expires")
+	if expires != "" {
+		ts, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || now.Unix() > ts {
+			logSampled("invalid_mac", "secure_link expired or malformed expiry: %s", expires)
+			securityEvent("expired_link")
+			return false
+		}
+	}
+	sum := md5.Sum([]byte(secureLinkInput(r, expires)))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(a.Get("md5"))) != 1 {
+		logSampled("invalid_mac", "Invalid secure_link MD5 for %s", r.URL.Path)
+		securityEvent("invalid_mac")
+		return false
+	}
+	return true
+}
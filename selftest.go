@@ -0,0 +1,123 @@
+package main
+
+/*
+ * prosody-filer -selftest https://upload.example.com
+ * Round trip against a running Filer with the same config: a signed
+ * upload, HEAD and GET (with signed links in SignedDownloads mode, checking
+ * unsigned ones get refused), then removal of the test file, through the
+ * API if there's an APIToken or straight from the bucket otherwise.
+ */
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type selftestStep struct {
+	name string
+	run  func() error
+}
+
+func expectStatus(resp *http.Response, err error, want int) error {
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != want {
+		return fmt.Errorf("got %s, want %d", resp.Status, want)
+	}
+	return nil
+}
+
+/*
+ * Runs the steps and prints how each went, returns whether all passed
+ */
+func runSelftest(base string) bool {
+	base = strings.TrimRight(base, "/")
+	key := "selftest/" + randomToken() + "/selftest.txt"
+	data := []byte("Prosody Filer selftest at " + time.Now().UTC().Format(time.RFC3339))
+	fileURL := base + "/" + conf.UploadSubDir + key
+	downloadURL := fileURL
+	if conf.SignedDownloads {
+		downloadURL = base + signedDownloadURL(key)
+	}
+	client := &http.Client{Timeout: time.Minute}
+
+	steps := []selftestStep{
+		{"upload", func() error {
+			q := url.Values{macSchemes[conf.Scheme].param: {macSchemes[conf.Scheme].sign(settings().Secret, key, int64(len(data)), "")}}
+			req, err := http.NewRequest("PUT", fileURL+"?"+q.Encode(), bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			resp, err := client.Do(req)
+			return expectStatus(resp, err, 201)
+		}},
+		{"head", func() error {
+			resp, err := client.Head(downloadURL)
+			if err := expectStatus(resp, err, 200); err != nil {
+				return err
+			}
+			// Not sent for HEAD in ProxyMode
+			if resp.ContentLength >= 0 && resp.ContentLength != int64(len(data)) {
+				return fmt.Errorf("Content-Length %d, want %d", resp.ContentLength, len(data))
+			}
+			return nil
+		}},
+		{"get", func() error {
+			resp, err := client.Get(downloadURL)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			got, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != 200 || !bytes.Equal(got, data) {
+				return fmt.Errorf("got %s with %d bytes, want 200 with the %d uploaded", resp.Status, len(got), len(data))
+			}
+			return nil
+		}},
+	}
+	if conf.SignedDownloads {
+		steps = append(steps, selftestStep{"unsigned get refused", func() error {
+			resp, err := client.Get(fileURL)
+			return expectStatus(resp, err, 403)
+		}})
+	}
+	steps = append(steps, selftestStep{"delete", func() error {
+		if conf.APIToken != "" {
+			req, err := http.NewRequest("DELETE", base+"/api/objects/"+key+"?reason=selftest", nil)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", "Bearer "+conf.APIToken)
+			resp, err := client.Do(req)
+			return expectStatus(resp, err, 204)
+		}
+		if err := storageLogin(); err != nil {
+			return err
+		}
+		return storageRemove(context.Background(), key)
+	}})
+
+	ok := true
+	for i, step := range steps {
+		err := step.run()
+		result := "ok"
+		if err != nil {
+			result = "FAILED: " + err.Error()
+			ok = false
+		}
+		fmt.Printf("%s. %-22s %s\n", strconv.Itoa(i+1), step.name, result)
+	}
+	return ok
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func controlService(cmd, configFile string) error {
+	return errors.New("-service is only supported on Windows")
+}
+
+func runService(run func() error, console bool) error {
+	if console {
+		return errors.New("-service is only supported on Windows")
+	}
+	return run()
+}
@@ -0,0 +1,142 @@
+//go:build windows
+
+package main
+
+/*
+ * Running as a Windows service. `prosody-filer -config C:\...\config.toml
+ * -service install` registers the service (remembering the config path) and
+ * an event log source; once started by the service manager, logging goes to
+ * the Windows event log. `-service run` runs it in the console instead,
+ * which helps when debugging a service that won't start.
+ */
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/debug"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "prosody-filer"
+
+func controlService(cmd, configFile string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	switch cmd {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		configFile, err = filepath.Abs(configFile)
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "Prosody Filer",
+			Description: "XMPP HTTP upload server",
+			StartType:   mgr.StartAutomatic,
+		}, "-config", configFile)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			return err
+		}
+		log.Printf("Service %s installed, using %s", serviceName, configFile)
+	case "uninstall":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		if err := eventlog.Remove(serviceName); err != nil {
+			return err
+		}
+		log.Printf("Service %s removed", serviceName)
+	default:
+		return fmt.Errorf("unknown -service command %q", cmd)
+	}
+	return nil
+}
+
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	if strings.Contains(msg, "Error") || strings.Contains(msg, "Failed") {
+		return len(p), w.elog.Error(1, msg)
+	}
+	return len(p), w.elog.Info(1, msg)
+}
+
+type filerService struct {
+	run func() error
+}
+
+func (fs filerService) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	s <- svc.Status{State: svc.StartPending}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fs.run()
+	}()
+	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-errc:
+			if err != nil {
+				log.Println("Error:", err)
+				return false, 1
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s <- svc.Status{State: svc.StopPending}
+				shutdownRequests <- syscall.SIGTERM
+			}
+		}
+	}
+}
+
+func runService(run func() error, console bool) error {
+	if console {
+		return debug.Run(serviceName, filerService{run})
+	}
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return run()
+	}
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+	log.SetFlags(0)
+	log.SetOutput(eventLogWriter{elog})
+	return svc.Run(serviceName, filerService{run})
+}
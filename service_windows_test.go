@@ -0,0 +1,55 @@
+//go:build windows
+
+package main
+
+/*
+ * The service manager side of running as a Windows service, without
+ * installing anything
+ */
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+func TestServiceStop(t *testing.T) {
+	run := func() error {
+		<-shutdownRequests
+		return nil
+	}
+	r := make(chan svc.ChangeRequest)
+	s := make(chan svc.Status, 10)
+	done := make(chan uint32, 1)
+	go func() {
+		_, code := filerService{run}.Execute(nil, r, s)
+		done <- code
+	}()
+
+	r <- svc.ChangeRequest{Cmd: svc.Interrogate, CurrentStatus: svc.Status{State: svc.Running}}
+	r <- svc.ChangeRequest{Cmd: svc.Stop}
+	select {
+	case code := <-done:
+		if code != 0 {
+			t.Errorf("Service exited with %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Service didn't stop")
+	}
+
+	var states []svc.State
+	for len(s) > 0 {
+		states = append(states, (<-s).State)
+	}
+	want := []svc.State{svc.StartPending, svc.Running, svc.Running, svc.StopPending}
+	if len(states) != len(want) {
+		t.Fatalf("Got states %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Errorf("Got states %v, want %v", states, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+/*
+ * Upload session pre-registration: the issuer registers an upcoming upload
+ * (key, size, type, uploader) and gets a token, which the PUT then carries
+ * in its "session" parameter instead of (or in addition to) a MAC. A session
+ * can only be used for one successful upload, and sessions that expire
+ * without one are reported as abandoned.
+ */
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	bolt "go.etcd.io/bbolt"
+)
+
+const sessionBucket = "sessions"
+
+type uploadSession struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Type     string    `json:"type,omitempty"`
+	Uploader string    `json:"uploader,omitempty"`
+	State    string    `json:"state"` // pending, uploading, complete
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+}
+
+var (
+	errSessionUnknown  = errors.New("unknown or expired upload session")
+	errSessionMismatch = errors.New("upload does not match session")
+	errSessionUsed     = errors.New("upload session already used")
+)
+
+var uploadSessions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "prosody_filer_upload_sessions_total",
+	Help: "Upload sessions by outcome (registered, complete, abandoned).",
+}, []string{"state"})
+
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalln("Can't get random bytes:", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+/*
+ * POST /api/sessions registers a session, GET /api/sessions/<token> shows it
+ */
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	if metaDB == nil {
+		http.Error(w, "501 Sessions need MetadataDB", 501)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, "/api/sessions/")
+	if r.Method == "GET" && token != r.URL.Path && token != "" {
+		var s uploadSession
+		err := metaDB.View(func(tx *bolt.Tx) error {
+			if !metaGet(tx, sessionBucket, token, &s) {
+				return errSessionUnknown
+			}
+			return nil
+		})
+		if err != nil {
+			http.Error(w, "404 Not Found", 404)
+			return
+		}
+		writeJSON(w, 200, s)
+		return
+	} else if r.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed", 405)
+		return
+	}
+
+	var s uploadSession
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.Key == "" || s.Size < 0 {
+		http.Error(w, "400 Bad Request", 400)
+		return
+	}
+	s.Key = strings.TrimPrefix(s.Key, "/")
+	if rej := checkUpload(userOf(s.Key), s.Key, s.Size); rej != nil {
+		http.Error(w, strconv.Itoa(rej.status)+" "+rej.reason, rej.status)
+		return
+	}
+	s.State = "pending"
+	s.Created = time.Now()
+	s.Expires = s.Created.Add(conf.UploadSessionTTL)
+	token = randomToken()
+
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		return metaPut(tx, sessionBucket, token, &s)
+	})
+	if err != nil {
+		log.Println("Failed to store upload session:", err)
+		http.Error(w, "500 Internal Server Error", 500)
+		return
+	}
+	uploadSessions.WithLabelValues("registered").Inc()
+	log.Printf("Registered upload session for %s (%d bytes) by %q", s.Key, s.Size, s.Uploader)
+
+	u := url.URL{Path: "/" + conf.UploadSubDir + s.Key, RawQuery: url.Values{"session": {token}}.Encode()}
+	writeJSON(w, 201, map[string]interface{}{
+		"token":   token,
+		"expires": s.Expires,
+		"put_url": u.String(),
+	})
+}
+
+/*
+ * Marks a session as in use by an upload, after checking that the upload
+ * matches what was registered
+ */
+func claimSession(token, fileStorePath string, size int64, ctype string) error {
+	if metaDB == nil {
+		return errSessionUnknown
+	}
+	return metaDB.Update(func(tx *bolt.Tx) error {
+		var s uploadSession
+		if !metaGet(tx, sessionBucket, token, &s) || time.Now().After(s.Expires) {
+			return errSessionUnknown
+		}
+		if s.Key != fileStorePath || s.Size != size || (s.Type != "" && s.Type != ctype) {
+			return errSessionMismatch
+		}
+		if s.State != "pending" {
+			return errSessionUsed
+		}
+		s.State = "uploading"
+		return metaPut(tx, sessionBucket, token, &s)
+	})
+}
+
+/*
+ * Marks a claimed session as complete, or makes it available for a retry
+ */
+func finishSession(token string, ok bool) {
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		var s uploadSession
+		if !metaGet(tx, sessionBucket, token, &s) {
+			return errSessionUnknown
+		}
+		if ok {
+			s.State = "complete"
+		} else {
+			s.State = "pending"
+		}
+		return metaPut(tx, sessionBucket, token, &s)
+	})
+	if err != nil {
+		log.Println("Failed to update upload session:", err)
+	} else if ok {
+		uploadSessions.WithLabelValues("complete").Inc()
+	}
+}
+
+/*
+ * Periodically drops expired sessions, reporting those never completed
+ */
+func expireSessions() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		err := metaDB.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(sessionBucket))
+			if b == nil {
+				return nil
+			}
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				var s uploadSession
+				if json.Unmarshal(v, &s) != nil || now.Before(s.Expires) {
+					continue
+				}
+				if s.State != "complete" {
+					log.Printf("Upload session for %s by %q abandoned", s.Key, s.Uploader)
+					uploadSessions.WithLabelValues("abandoned").Inc()
+				}
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("Failed to expire upload sessions:", err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+/*
+ * Short download links (/d/<code>), for SMS gateways and old clients that
+ * mangle the long upload URLs. The code maps to the full download URL in
+ * MetadataDB, including its signature in SignedDownloads mode, so the code
+ * is long enough to be unguessable and a short link grants exactly what the
+ * long one does. The codes of each file are indexed too, so they can be
+ * dropped with it.
+ */
+
+import (
+	"crypto/rand"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	shortLinkBucket    = "shortlinks"
+	shortLinkKeyBucket = "shortlink_keys"
+)
+
+const (
+	shortLinkAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	shortLinkLength   = 10 // ~59 bits
+)
+
+type shortLink struct {
+	Key     string    `json:"key"`
+	Target  string    `json:"target"`
+	Created time.Time `json:"created"`
+}
+
+func shortLinkCode() string {
+	b := make([]byte, shortLinkLength)
+	max := big.NewInt(int64(len(shortLinkAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			log.Fatalln("Can't get random bytes:", err)
+		}
+		b[i] = shortLinkAlphabet[n.Int64()]
+	}
+	return string(b)
+}
+
+/*
+ * Creates a short link to the download URL of fileStorePath, returning its
+ * path ("/d/<code>")
+ */
+func createShortLink(fileStorePath string) (string, error) {
+	target := (&url.URL{Path: "/" + conf.UploadSubDir + fileStorePath}).String()
+	if conf.SignedDownloads {
+		target = signedDownloadURL(fileStorePath)
+	}
+	code := shortLinkCode()
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		var codes []string
+		metaGet(tx, shortLinkKeyBucket, fileStorePath, &codes)
+		if err := metaPut(tx, shortLinkKeyBucket, fileStorePath, append(codes, code)); err != nil {
+			return err
+		}
+		return metaPut(tx, shortLinkBucket, code, shortLink{fileStorePath, target, time.Now()})
+	})
+	return "/d/" + code, err
+}
+
+/*
+ * Removes the short links to a file that's gone
+ */
+func dropShortLinks(fileStorePath string) {
+	if metaDB == nil || !conf.ShortLinks {
+		return
+	}
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		var codes []string
+		if !metaGet(tx, shortLinkKeyBucket, fileStorePath, &codes) {
+			return nil
+		}
+		for _, code := range codes {
+			if err := metaDelete(tx, shortLinkBucket, code); err != nil {
+				return err
+			}
+		}
+		return metaDelete(tx, shortLinkKeyBucket, fileStorePath)
+	})
+	if err != nil {
+		log.Println("Failed to drop short links:", err)
+	}
+}
+
+/*
+ * GET /d/<code> redirects to the full URL
+ */
+func handleShortLink(w http.ResponseWriter, r *http.Request) {
+	code := strings.TrimPrefix(r.URL.Path, "/d/")
+	var l shortLink
+	found := false
+	metaDB.View(func(tx *bolt.Tx) error {
+		found = metaGet(tx, shortLinkBucket, code, &l)
+		return nil
+	})
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, l.Target, http.StatusFound)
+}
+
+/*
+ * POST /api/shortlinks?key=<path>, for the XMPP server or bots
+ */
+func handleShortLinks(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	if !conf.ShortLinks || metaDB == nil {
+		http.Error(w, "501 Short links not enabled", 501)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed", 405)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Query().Get("key"), "/")
+	if key == "" {
+		http.Error(w, "400 Need key", 400)
+		return
+	}
+	link, err := createShortLink(key)
+	if err != nil {
+		log.Println("Failed to store short link:", err)
+		http.Error(w, "500 Internal Server Error", 500)
+		return
+	}
+	writeJSON(w, 201, map[string]string{"path": link})
+}
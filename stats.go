@@ -0,0 +1,81 @@
+package main
+
+/*
+ * A JSON summary of the metrics at /stats, for monitoring scripts that
+ * don't speak Prometheus
+ */
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	startTime = time.Now()
+
+	statRequests     int64
+	statErrors       int64
+	statServerErrors int64
+	statBytesIn      int64
+	statBytesOut     int64
+	statInFlight     int64
+	statCacheHits    int64
+	statCacheMisses  int64
+)
+
+type statsSnapshot struct {
+	Uptime         string  `json:"uptime"`
+	UptimeSeconds  int64   `json:"uptime_seconds"`
+	Requests       int64   `json:"requests"`
+	Errors         int64   `json:"errors"`
+	BytesIn        int64   `json:"bytes_in"`
+	BytesOut       int64   `json:"bytes_out"`
+	InFlight       int64   `json:"in_flight"`
+	CacheHits      int64   `json:"cache_hits"`
+	CacheMisses    int64   `json:"cache_misses"`
+	CacheHitRate   float64 `json:"cache_hit_rate"`
+	StorageHealthy bool    `json:"storage_healthy"`
+}
+
+func countStats(rec *responseRecorder, body *countingReader) {
+	atomic.AddInt64(&statRequests, 1)
+	if rec.status >= 400 {
+		atomic.AddInt64(&statErrors, 1)
+	}
+	if rec.status >= 500 {
+		atomic.AddInt64(&statServerErrors, 1)
+	}
+	atomic.AddInt64(&statBytesIn, body.read)
+	atomic.AddInt64(&statBytesOut, rec.written)
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "405 Method Not Allowed", 405)
+		return
+	}
+	uptime := time.Since(startTime)
+	hits, misses := atomic.LoadInt64(&statCacheHits), atomic.LoadInt64(&statCacheMisses)
+	// Of the downloads we tried to serve from CacheDir
+	rate := 0.0
+	if hits+misses > 0 {
+		rate = float64(hits) / float64(hits+misses)
+	}
+	writeJSON(w, 200, statsSnapshot{
+		Uptime:         uptime.Round(time.Second).String(),
+		UptimeSeconds:  int64(uptime.Seconds()),
+		Requests:       atomic.LoadInt64(&statRequests),
+		Errors:         atomic.LoadInt64(&statErrors),
+		BytesIn:        atomic.LoadInt64(&statBytesIn),
+		BytesOut:       atomic.LoadInt64(&statBytesOut),
+		InFlight:       atomic.LoadInt64(&statInFlight),
+		CacheHits:      hits,
+		CacheMisses:    misses,
+		CacheHitRate:   rate,
+		StorageHealthy: !storageDown(),
+	})
+}
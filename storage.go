@@ -0,0 +1,366 @@
+package main
+
+/*
+ * All storage calls go through these, so they're timed and errors counted
+ * per operation, and have deadlines: S3Timeout for quick calls (stat,
+ * presign, remove, multipart bookkeeping), and for transfers
+ * S3TransferTimeout plus the time the data takes at S3MinThroughput.
+ *
+ * The basic file operations go to a StorageBackend, so other stores can be
+ * plugged in. The rest (listing, copies, multipart uploads) is S3 only.
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"math"
+	"net/url"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/lifecycle"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+/*
+ * A stored file being read. Object info and errors are in S3's terms
+ * (missing files are NoSuchKey), whatever the backend.
+ */
+type StorageObject interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Stat() (minio.ObjectInfo, error)
+}
+
+type StorageBackend interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, opt minio.PutObjectOptions) (minio.UploadInfo, error)
+	// Needn't touch the store until the object is read or Stat'ed
+	Get(ctx context.Context, key string) (StorageObject, error)
+	Stat(ctx context.Context, key string) (minio.ObjectInfo, error)
+	Presign(ctx context.Context, key string, expiry time.Duration, params url.Values) (*url.URL, error)
+	Remove(ctx context.Context, key string) error
+}
+
+var backend StorageBackend
+
+/*
+ * Backends that list their own files rather than through S3
+ */
+type StorageLister interface {
+	List(ctx context.Context, prefix string) <-chan minio.ObjectInfo
+}
+
+type s3Backend struct {
+	client *minio.Client
+}
+
+func (b s3Backend) Put(ctx context.Context, key string, body io.Reader, size int64, opt minio.PutObjectOptions) (minio.UploadInfo, error) {
+	return b.client.PutObject(ctx, conf.S3Bucket, key, body, size, opt)
+}
+
+func (b s3Backend) Get(ctx context.Context, key string) (StorageObject, error) {
+	obj, err := b.client.GetObject(ctx, conf.S3Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (b s3Backend) Stat(ctx context.Context, key string) (minio.ObjectInfo, error) {
+	return b.client.StatObject(ctx, conf.S3Bucket, key, minio.StatObjectOptions{})
+}
+
+func (b s3Backend) Presign(ctx context.Context, key string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	return b.client.PresignedGetObject(ctx, conf.S3Bucket, key, expiry, params)
+}
+
+func (b s3Backend) Remove(ctx context.Context, key string) error {
+	return b.client.RemoveObject(ctx, conf.S3Bucket, key, minio.RemoveObjectOptions{})
+}
+
+var (
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prosody_filer_storage_duration_seconds",
+		Help:    "Latency of storage backend calls by operation.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"operation"})
+	storageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prosody_filer_storage_errors_total",
+		Help: "Failed storage backend calls by operation and error class.",
+	}, []string{"operation", "class"})
+)
+
+/*
+ * Deadline for a transfer of size bytes, 0 for none (unknown size, the
+ * caller has to set one itself)
+ */
+func transferTimeout(size int64) time.Duration {
+	if size < 0 || conf.S3TransferTimeout <= 0 {
+		return 0
+	}
+	t := conf.S3TransferTimeout
+	if conf.S3MinThroughput > 0 {
+		t += time.Duration(size/conf.S3MinThroughput) * time.Second
+	}
+	return t
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func observeStorage(op string, start time.Time, err *error) {
+	storageDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		storageErrors.WithLabelValues(op, storageErrorClass(*err)).Inc()
+	}
+	if *err == nil || !isBackendFailure(*err) {
+		breakerRecord(true)
+	} else {
+		breakerRecord(false)
+	}
+}
+
+func storagePut(ctx context.Context, key string, body io.Reader, size int64, opt minio.PutObjectOptions) (info minio.UploadInfo, err error) {
+	defer observeStorage("put", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, transferTimeout(size))
+	defer cancel()
+	if _, ok := body.(io.Seeker); ok {
+		// A file or buffer, which the S3 client may want to rewind
+		return backend.Put(ctx, key, body, size, opt)
+	}
+	br := &bodyReader{r: body}
+	info, err = backend.Put(ctx, key, br, size, opt)
+	if err != nil && br.err != nil {
+		err = br.err
+	}
+	return info, err
+}
+
+/*
+ * Remembers why reading an upload failed: the S3 client reports that as a
+ * failed request to S3, which would count against the backend
+ */
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+/*
+ * GetObject doesn't talk to S3 until the first read, so Stat right away to
+ * get a meaningful latency (and errors here rather than halfway a response).
+ * The object is read after we return, so the deadlines are timers: S3Timeout
+ * for the Stat, then the transfer deadline for the size we got.
+ */
+func storageGet(ctx context.Context, key string) (obj StorageObject, err error) {
+	defer observeStorage("get", time.Now(), &err)
+	ctx, cancel := context.WithCancel(ctx)
+	statTimeout := conf.S3Timeout
+	if statTimeout <= 0 {
+		statTimeout = math.MaxInt64
+	}
+	timer := time.AfterFunc(statTimeout, cancel)
+	var info minio.ObjectInfo
+	obj, err = backend.Get(ctx, key)
+	if err == nil {
+		if info, err = obj.Stat(); err != nil {
+			obj.Close()
+		}
+	}
+	if hasLegacy() && isNotFound(err) {
+		obj, err = legacyGet(ctx, key)
+		if err == nil {
+			info, err = obj.Stat()
+		}
+	}
+	if !timer.Stop() && err == nil {
+		// Too late, the object would fail on the first read
+		obj.Close()
+		cancel()
+		return nil, context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return obj, err
+	}
+	// Otherwise released with the caller's context
+	if d := transferTimeout(info.Size); d > 0 {
+		time.AfterFunc(d, cancel)
+	}
+	return obj, nil
+}
+
+func storageStat(ctx context.Context, key string) (info minio.ObjectInfo, err error) {
+	defer observeStorage("stat", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3Timeout)
+	defer cancel()
+	info, err = backend.Stat(ctx, key)
+	if hasLegacy() && isNotFound(err) {
+		return legacyStat(ctx, key)
+	}
+	return info, err
+}
+
+func storagePresign(ctx context.Context, key string, expiry time.Duration, params url.Values) (u *url.URL, err error) {
+	defer observeStorage("presign", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3Timeout)
+	defer cancel()
+	if hasLegacy() {
+		if u, legacy, err := legacyPresign(ctx, key, expiry, params); legacy {
+			return u, err
+		}
+	}
+	return backend.Presign(ctx, key, expiry, params)
+}
+
+func storagePresignPost(ctx context.Context, policy *minio.PostPolicy) (u *url.URL, fields map[string]string, err error) {
+	defer observeStorage("presign_post", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3Timeout)
+	defer cancel()
+	return s3Client.PresignedPostPolicy(ctx, policy)
+}
+
+func storageRemove(ctx context.Context, key string) (err error) {
+	defer observeStorage("remove", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3Timeout)
+	defer cancel()
+	uncache(key)
+	if hasLegacy() {
+		if err := legacyRemove(ctx, key); err != nil {
+			return err
+		}
+	}
+	return backend.Remove(ctx, key)
+}
+
+/*
+ * Listing is streamed, so only errors are counted
+ */
+func storageList(ctx context.Context, prefix string) <-chan minio.ObjectInfo {
+	if l, ok := backend.(StorageLister); ok {
+		return l.List(ctx, prefix)
+	}
+	out := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(out)
+		for entry := range s3Client.ListObjects(ctx, conf.S3Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			if entry.Err != nil {
+				storageErrors.WithLabelValues("list", storageErrorClass(entry.Err)).Inc()
+			}
+			// The caller may stop reading, and cancel
+			select {
+			case out <- entry:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func storageCompose(ctx context.Context, dst minio.CopyDestOptions, srcs []minio.CopySrcOptions) (info minio.UploadInfo, err error) {
+	defer observeStorage("compose", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3TransferTimeout)
+	defer cancel()
+	return s3Client.ComposeObject(ctx, dst, srcs...)
+}
+
+func storageCopy(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (info minio.UploadInfo, err error) {
+	defer observeStorage("copy", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3TransferTimeout)
+	defer cancel()
+	return s3Client.CopyObject(ctx, dst, src)
+}
+
+func storageGetLifecycle(ctx context.Context) (config *lifecycle.Configuration, err error) {
+	defer observeStorage("get_lifecycle", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3Timeout)
+	defer cancel()
+	return s3Client.GetBucketLifecycle(ctx, conf.S3Bucket)
+}
+
+func storageSetLifecycle(ctx context.Context, config *lifecycle.Configuration) (err error) {
+	defer observeStorage("set_lifecycle", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3Timeout)
+	defer cancel()
+	return s3Client.SetBucketLifecycle(ctx, conf.S3Bucket, config)
+}
+
+/*
+ * Multipart upload primitives
+ */
+func storageListMultipart(ctx context.Context, key string) (res minio.ListMultipartUploadsResult, err error) {
+	defer observeStorage("list_multipart", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3Timeout)
+	defer cancel()
+	return s3Core.ListMultipartUploads(ctx, conf.S3Bucket, key, "", "", "", 1000)
+}
+
+func storageListMultipartPage(ctx context.Context, keyMarker, uploadIDMarker string) (res minio.ListMultipartUploadsResult, err error) {
+	defer observeStorage("list_multipart", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3Timeout)
+	defer cancel()
+	return s3Core.ListMultipartUploads(ctx, conf.S3Bucket, "", keyMarker, uploadIDMarker, "", 1000)
+}
+
+func storageListParts(ctx context.Context, key, uploadID string, marker int) (res minio.ListObjectPartsResult, err error) {
+	defer observeStorage("list_parts", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3Timeout)
+	defer cancel()
+	return s3Core.ListObjectParts(ctx, conf.S3Bucket, key, uploadID, marker, 1000)
+}
+
+func storageNewMultipart(ctx context.Context, key string, opt minio.PutObjectOptions) (uploadID string, err error) {
+	defer observeStorage("new_multipart", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3Timeout)
+	defer cancel()
+	return s3Core.NewMultipartUpload(ctx, conf.S3Bucket, key, opt)
+}
+
+/*
+ * Parts are in memory anyway, so they're sent with their checksums for S3 to
+ * verify, which also saves the chunked signing of plain HTTP requests
+ */
+func storagePutPart(ctx context.Context, key, uploadID string, n int, data []byte) (part minio.ObjectPart, err error) {
+	defer observeStorage("put_part", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, transferTimeout(int64(len(data))))
+	defer cancel()
+	md5sum, sha := md5.Sum(data), sha256.Sum256(data)
+	opts := minio.PutObjectPartOptions{
+		Md5Base64:            base64.StdEncoding.EncodeToString(md5sum[:]),
+		Sha256Hex:            hex.EncodeToString(sha[:]),
+		DisableContentSha256: true,
+	}
+	return s3Core.PutObjectPart(ctx, conf.S3Bucket, key, uploadID, n, bytes.NewReader(data), int64(len(data)), opts)
+}
+
+func storageCompleteMultipart(ctx context.Context, key, uploadID string, parts []minio.CompletePart, opt minio.PutObjectOptions) (info minio.UploadInfo, err error) {
+	defer observeStorage("complete_multipart", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3TransferTimeout)
+	defer cancel()
+	return s3Core.CompleteMultipartUpload(ctx, conf.S3Bucket, key, uploadID, parts, opt)
+}
+
+func storageAbortMultipart(ctx context.Context, key, uploadID string) (err error) {
+	defer observeStorage("abort_multipart", time.Now(), &err)
+	ctx, cancel := withTimeout(ctx, conf.S3Timeout)
+	defer cancel()
+	return s3Core.AbortMultipartUpload(ctx, conf.S3Bucket, key, uploadID)
+}
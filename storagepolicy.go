@@ -0,0 +1,162 @@
+package main
+
+/*
+ * Storage policies for parts of the key space, so communities sharing an
+ * instance can get different guarantees. Each [[StoragePolicies]] entry
+ * applies to keys under Prefix and/or requests for Tenant (the domain, as
+ * in Tenants), and sets any of:
+ *
+ *  - Encrypt: whether uploads are encrypted at rest (needs EncryptionKey)
+ *  - StorageClass: the S3 storage class new uploads go to
+ *  - Retention: how long uploads are kept before being pruned (needs
+ *    MetadataDB, where the deadline is recorded as they're stored)
+ *  - MaxFileSize: larger uploads get 413
+ *  - ProxyMode: whether downloads are proxied or redirected to S3
+ *
+ * Everything matching a request applies, more specific prefixes last, so
+ * they win over tenant-wide settings.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const retentionBucket = "retention"
+
+type StoragePolicy struct {
+	Prefix       string
+	Tenant       string
+	Encrypt      *bool
+	StorageClass string
+	Retention    time.Duration
+	MaxFileSize  int64
+	ProxyMode    *bool
+}
+
+/*
+ * The settings that apply to one request
+ */
+type effectivePolicy struct {
+	encrypt      bool
+	storageClass string
+	retention    time.Duration
+	maxFileSize  int64
+	proxy        bool
+}
+
+func storagePolicyFor(r *http.Request, key string) effectivePolicy {
+	eff := effectivePolicy{encrypt: encryptionKey != nil, proxy: conf.ProxyMode}
+	var matching []StoragePolicy
+	for _, p := range conf.StoragePolicies {
+		if p.Tenant != "" && p.Tenant != requestHost(r) {
+			continue
+		}
+		if !strings.HasPrefix(key, p.Prefix) {
+			continue
+		}
+		matching = append(matching, p)
+	}
+	sort.SliceStable(matching, func(i, j int) bool { return len(matching[i].Prefix) < len(matching[j].Prefix) })
+	for _, p := range matching {
+		if p.Encrypt != nil {
+			eff.encrypt = *p.Encrypt
+		}
+		if p.StorageClass != "" {
+			eff.storageClass = p.StorageClass
+		}
+		if p.Retention != 0 {
+			eff.retention = p.Retention
+		}
+		if p.MaxFileSize != 0 {
+			eff.maxFileSize = p.MaxFileSize
+		}
+		if p.ProxyMode != nil {
+			eff.proxy = *p.ProxyMode
+		}
+	}
+	if conf.EmbeddedStorage != "" || conf.StorageType == "local" {
+		// Nothing to redirect to
+		eff.proxy = true
+	}
+	return eff
+}
+
+func checkStoragePolicies() {
+	for i := range conf.StoragePolicies {
+		p := &conf.StoragePolicies[i]
+		p.Tenant = strings.ToLower(p.Tenant)
+		if p.Prefix == "" && p.Tenant == "" {
+			log.Fatal("StoragePolicies entries need a Prefix or Tenant")
+		}
+		if p.Encrypt != nil && *p.Encrypt && encryptionKey == nil {
+			log.Fatal("StoragePolicies with Encrypt need EncryptionKey")
+		}
+		if p.Retention != 0 && conf.MetadataDB == "" {
+			log.Fatal("StoragePolicies with Retention need MetadataDB")
+		}
+	}
+}
+
+/*
+ * Records when a new upload is to be pruned, if its policy says so
+ */
+func recordRetention(key string, pol effectivePolicy, now time.Time) {
+	if pol.retention <= 0 || metaDB == nil {
+		return
+	}
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		return metaPut(tx, retentionBucket, key, now.Add(pol.retention))
+	})
+	if err != nil {
+		log.Println("Failed to record retention:", err)
+	}
+}
+
+func runRetention() {
+	if metaDB == nil {
+		return
+	}
+	for range time.Tick(time.Hour) {
+		pruneExpired(context.Background(), time.Now())
+	}
+}
+
+/*
+ * Removes the files whose retention period is over
+ */
+func pruneExpired(ctx context.Context, now time.Time) {
+	var expired []string
+	metaDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(retentionBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var until time.Time
+			if json.Unmarshal(v, &until) == nil && now.After(until) {
+				expired = append(expired, string(k))
+			}
+			return nil
+		})
+	})
+	for _, key := range expired {
+		err := removeObject(ctx, "prune", "retention", "retention period over", key)
+		if err == nil {
+			log.Println("Pruned", key, "after its retention period")
+		} else if !isNotFound(err) {
+			log.Println("Failed to prune", key, err)
+			continue
+		}
+		metaDB.Update(func(tx *bolt.Tx) error {
+			return metaDelete(tx, retentionBucket, key)
+		})
+	}
+}
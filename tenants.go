@@ -0,0 +1,111 @@
+package main
+
+/*
+ * Branded download domains for hosted communities sharing one instance.
+ * Uploads arriving on a tenant's domain (the Host the XMPP server hands out
+ * in its slots) get their download links on the tenant's DownloadHost,
+ * which serves downloads only, with its own certificate if it has one.
+ * Files are stored in the same namespace for all tenants.
+ */
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type TenantConfig struct {
+	DownloadHost string
+	// Certificate for DownloadHost, if serving TLS ourselves
+	TLSCert string
+	TLSKey  string
+}
+
+func requestHost(r *http.Request) string {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+/*
+ * The download link for rel (a path and query) on the download host of
+ * the tenant r came in for, rel itself if it has none
+ */
+func tenantURL(r *http.Request, rel string) string {
+	t, ok := conf.Tenants[requestHost(r)]
+	if !ok || t.DownloadHost == "" {
+		return rel
+	}
+	scheme := "https"
+	if r.TLS == nil && conf.TLSCert == "" && r.Header.Get("X-Forwarded-Proto") == "http" {
+		scheme = "http"
+	}
+	return scheme + "://" + t.DownloadHost + rel
+}
+
+func isDownloadHost(host string) bool {
+	for _, t := range conf.Tenants {
+		if strings.EqualFold(t.DownloadHost, host) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Only lets downloads through on tenants' download hosts
+ */
+func tenantRouter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isDownloadHost(requestHost(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+			http.Error(w, "405 Method Not Allowed", 405)
+			return
+		}
+		for _, prefix := range []string{"/" + conf.UploadSubDir, "/raw/", "/view/", "/d/"} {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if r.URL.Path == "/robots.txt" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	})
+}
+
+/*
+ * Picks the tenant certificate for download hosts that have one, falling
+ * back to the main certificate
+ */
+func tenantCertificates(fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	certs := make(map[string]*certReloader)
+	for _, t := range conf.Tenants {
+		if t.TLSCert == "" {
+			continue
+		}
+		cr, err := newCertReloader(t.TLSCert, t.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		go cr.watch()
+		certs[strings.ToLower(t.DownloadHost)] = cr
+	}
+	if len(certs) == 0 {
+		return fallback, nil
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if cr, ok := certs[strings.ToLower(hello.ServerName)]; ok {
+			return cr.GetCertificate(hello)
+		}
+		return fallback(hello)
+	}, nil
+}
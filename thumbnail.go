@@ -0,0 +1,156 @@
+package main
+
+/*
+ * On-the-fly thumbnails of uploaded images (proxied through us). Resizing is
+ * expensive, so the variant parameters must be covered by a signature or
+ * anyone could use us as a CPU amplifier by requesting endless sizes.
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"image"
+	_ "image/gif" // register decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// Query parameters that select a derivative instead of the original file
+var variantParams = []string{"w"}
+
+// Refuse to decode anything bigger than this (decompression bombs)
+const maxThumbnailSourcePixels = 50 * 1000 * 1000
+
+/*
+ * Whether a derivative is asked for. Without Thumbnails the parameters are
+ * ignored, and the original is served.
+ */
+func isVariantRequest(a url.Values) bool {
+	if !conf.Thumbnails {
+		return false
+	}
+	for _, p := range variantParams {
+		if a.Get(p) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Canonical form of the variant parameters, which is what gets signed
+ */
+func variantString(a url.Values) string {
+	v := make(url.Values)
+	for _, p := range variantParams {
+		if a.Get(p) != "" {
+			v.Set(p, a.Get(p))
+		}
+	}
+	return v.Encode()
+}
+
+func signVariant(secret, fileStorePath string, a url.Values) string {
+	return hmacHex(secret, "VARIANT "+fileStorePath+" "+variantString(a))
+}
+
+/*
+ * Returns the query string (including signature "vs") for a thumbnail of
+ * the given width
+ */
+func thumbnailQuery(fileStorePath string, width int) url.Values {
+	q := url.Values{"w": {strconv.Itoa(width)}}
+	q.Set("vs", signVariant(settings().Secret, fileStorePath, q))
+	return q
+}
+
+func verifyVariant(fileStorePath string, a url.Values) bool {
+	for _, k := range acceptedMACKeys(time.Now()) {
+		if hmac.Equal([]byte(signVariant(k.secret, fileStorePath, a)), []byte(a.Get("vs"))) {
+			return true
+		}
+	}
+	logSampled("invalid_mac", "Invalid variant MAC for %s %s", fileStorePath, variantString(a))
+	securityEvent("invalid_variant_mac")
+	return false
+}
+
+/*
+ * Serves a resized version of an image. The signedDownload check has verified
+ * the variant signature, which also authorizes the download in
+ * SignedDownloads mode.
+ */
+func serveThumbnail(w http.ResponseWriter, r *http.Request, fileStorePath string, a url.Values) {
+	width, err := strconv.Atoi(a.Get("w"))
+	if err != nil || width < 1 || width > conf.ThumbnailMaxWidth {
+		httpError(w, "bad_request", "400 Invalid thumbnail width", 400)
+		return
+	}
+
+	obj, err := storageGet(context.Background(), fileStorePath)
+	if err != nil {
+		log.Println("Storage error:", err)
+		httpError(w, storageErrorClass(err), "Storage error", 502)
+		return
+	}
+	defer obj.Close()
+
+	var body io.Reader = obj
+	if info, err := obj.Stat(); err == nil && isStoredOpaque(info) {
+		httpError(w, "unsupported_type", "415 Unsupported Media Type", 415)
+		return
+	} else if err == nil && isStoredEncrypted(info) {
+		body = decryptBody(obj)
+	}
+
+	// Check the dimensions before decoding the whole thing, then decode from
+	// what we've read so far plus the rest
+	var head bytes.Buffer
+	cfg, format, err := image.DecodeConfig(io.TeeReader(body, &head))
+	if err != nil || cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		log.Println("Not thumbnailing", fileStorePath, format, err)
+		httpError(w, "unsupported_type", "415 Unsupported Media Type", 415)
+		return
+	}
+	src, _, err := image.Decode(io.MultiReader(&head, body))
+	if err != nil {
+		log.Println("Failed to decode image:", err)
+		httpError(w, "unsupported_type", "415 Unsupported Media Type", 415)
+		return
+	}
+
+	b := src.Bounds()
+	if width > b.Dx() {
+		width = b.Dx()
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+
+	if _, protected := lookupFilePassword(fileStorePath); !protected {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	}
+	if format == "png" || format == "gif" {
+		// Keep transparency
+		w.Header().Set("Content-Type", "image/png")
+		err = png.Encode(w, dst)
+	} else {
+		w.Header().Set("Content-Type", "image/jpeg")
+		err = jpeg.Encode(w, dst, &jpeg.Options{Quality: 80})
+	}
+	if err != nil {
+		log.Println("Failed to write thumbnail:", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+/*
+ * Serving HTTPS directly from TLSCert and TLSKey. The files are checked
+ * for changes every minute (and reloaded on SIGHUP), so certificates
+ * renewed by an external ACME client are picked up without a restart. If
+ * loading the new files fails, we keep using the old certificate.
+ *
+ * Without a reverse proxy in front, HTTPRedirectListenport (usually :80)
+ * sends clients that come in over plain HTTP to the HTTPS port.
+ */
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+/*
+ * Latest modification time of the certificate and key files
+ */
+func (cr *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) load() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+func (cr *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	tick := time.NewTicker(time.Minute)
+	for {
+		select {
+		case <-hup:
+			cr.reload(true)
+		case <-tick.C:
+			cr.reload(false)
+		}
+	}
+}
+
+/*
+ * Loads the files again if they changed, or regardless with force
+ */
+func (cr *certReloader) reload(force bool) {
+	modTime, err := cr.filesModTime()
+	cr.mu.RLock()
+	changed := err == nil && !modTime.Equal(cr.modTime)
+	cr.mu.RUnlock()
+	if !force && !changed {
+		return
+	}
+	if err := cr.load(); err != nil {
+		log.Println("Failed to reload TLS certificate, keeping the old one:", err)
+		return
+	}
+	log.Println("Reloaded TLS certificate from", cr.certFile)
+}
+
+/*
+ * TLS configuration for the main listener, nil if TLS isn't configured
+ */
+func serverTLSConfig() (*tls.Config, error) {
+	tlsConfig := acmeTLSConfig()
+	if tlsConfig == nil {
+		if conf.TLSCert == "" && conf.TLSKey == "" {
+			return nil, nil
+		}
+		cr, err := newCertReloader(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		go cr.watch()
+		tlsConfig = &tls.Config{GetCertificate: cr.GetCertificate}
+	}
+	getCert, err := tenantCertificates(tlsConfig.GetCertificate)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.GetCertificate = getCert
+	return tlsConfig, nil
+}
+
+/*
+ * Binds HTTPRedirectListenport, if set and not passed by systemd, before
+ * we drop privileges
+ */
+func serveHTTPRedirect() error {
+	lns := redirectListeners
+	if len(lns) == 0 && conf.HTTPRedirectListenport != "" {
+		ln, err := net.Listen(conf.ListenNetwork, conf.HTTPRedirectListenport)
+		if err != nil {
+			return err
+		}
+		lns = append(lns, ln)
+	}
+	srv := &http.Server{
+		Handler:           acmeHTTPHandler(http.HandlerFunc(handleHTTPSRedirect)),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			log.Printf("Redirecting HTTP on %s to HTTPS\n", ln.Addr())
+			log.Fatalln(srv.Serve(ln))
+		}(ln)
+	}
+	return nil
+}
+
+/*
+ * 308 so uploads are repeated as PUT rather than turned into a GET
+ */
+func handleHTTPSRedirect(w http.ResponseWriter, r *http.Request) {
+	host := requestHost(r)
+	if host == "" {
+		http.Error(w, "400 Bad Request", 400)
+		return
+	}
+	if _, port, err := net.SplitHostPort(conf.Listenport); err == nil && port != "443" && port != "https" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
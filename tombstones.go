@@ -0,0 +1,88 @@
+package main
+
+/*
+ * Tombstones for removed files: a small record in MetadataDB of why a file
+ * is gone, so downloads get a 410 Gone saying so ("This file expired")
+ * instead of a bare 404. The body is TombstoneMessages[action], action
+ * being what removed the file ("delete", "prune", "quarantine"). Uploading
+ * the file again clears it.
+ */
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const tombstoneBucket = "tombstones"
+
+type tombstone struct {
+	Action  string    `json:"action"`
+	Removed time.Time `json:"removed"`
+}
+
+var defaultTombstoneMessages = map[string]string{
+	"delete":     "This file has been removed.",
+	"prune":      "This file has expired.",
+	"quarantine": "This file has been removed by a moderator.",
+}
+
+func recordTombstone(key, action string) {
+	if metaDB == nil || !conf.Tombstones {
+		return
+	}
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		return metaPut(tx, tombstoneBucket, key, tombstone{action, time.Now()})
+	})
+	if err != nil {
+		log.Println("Failed to record tombstone:", err)
+	}
+}
+
+func clearTombstone(key string) {
+	if metaDB == nil || !conf.Tombstones {
+		return
+	}
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		return metaDelete(tx, tombstoneBucket, key)
+	})
+	if err != nil {
+		log.Println("Failed to clear tombstone:", err)
+	}
+}
+
+/*
+ * Answers 410 if key was removed. Returns false if the request should not
+ * go on.
+ */
+func checkTombstone(w http.ResponseWriter, key string) bool {
+	if metaDB == nil || !conf.Tombstones {
+		return true
+	}
+	var t tombstone
+	var found bool
+	metaDB.View(func(tx *bolt.Tx) error {
+		found = metaGet(tx, tombstoneBucket, key, &t)
+		return nil
+	})
+	if !found {
+		return true
+	}
+	msg, ok := conf.TombstoneMessages[t.Action]
+	if !ok {
+		msg = defaultTombstoneMessages[t.Action]
+	}
+	if msg == "" {
+		msg = "This file is no longer available."
+	}
+	if rec, ok := w.(*responseRecorder); ok {
+		rec.class = "gone"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusGone)
+	w.Write([]byte(msg + "\n"))
+	return false
+}
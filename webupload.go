@@ -0,0 +1,88 @@
+package main
+
+/*
+ * Small drag-and-drop upload page at /share/, for sharing files with people
+ * who don't use XMPP and for trying out the service by hand. Users log in
+ * with HTTP basic auth (WebUploadUsers); the page asks us for a slot, which
+ * we sign with our own secret, and then uploads through the normal PUT path.
+ */
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+//go:embed webupload.html
+var webUploadPage []byte
+
+func webUploadUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if ok {
+		if want, exists := conf.WebUploadUsers[user]; exists && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1 {
+			return user, true
+		}
+		logSampled("web_upload_unauthorized", "Web upload: failed login for %q from %s", user, r.RemoteAddr)
+		securityEvent("api_unauthorized")
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="prosody-filer"`)
+	http.Error(w, "401 Unauthorized", 401)
+	return "", false
+}
+
+/*
+ * GET /share/ serves the page, POST /share/slot {"name", "size", "type"}
+ * returns {"put": <upload URL>, "get": <download URL>}
+ */
+func handleWebUpload(w http.ResponseWriter, r *http.Request) {
+	user, ok := webUploadUser(w, r)
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/share/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		w.Write(webUploadPage)
+	case r.Method == "POST" && r.URL.Path == "/share/slot":
+		if !checkMaintenance(w) {
+			return
+		}
+		var req struct {
+			Name string
+			Size int64
+			Type string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Size < 0 {
+			http.Error(w, "400 Need name and size", 400)
+			return
+		}
+		name := path.Base(strings.ReplaceAll(req.Name, "\\", "/"))
+		if name == "." || name == "/" || strings.HasPrefix(name, ".") {
+			http.Error(w, "400 Invalid file name", 400)
+			return
+		}
+		fileStorePath := path.Join(user, randomToken(), name)
+		if rej := checkUpload(user, fileStorePath, req.Size); rej != nil {
+			http.Error(w, rej.reason, rej.status)
+			return
+		}
+
+		put := url.URL{Path: "/" + conf.UploadSubDir + fileStorePath}
+		q := url.Values{macSchemes[conf.Scheme].param: {macSchemes[conf.Scheme].sign(settings().Secret, fileStorePath, req.Size, req.Type)}}
+		put.RawQuery = q.Encode()
+		get := (&url.URL{Path: "/" + conf.UploadSubDir + fileStorePath}).String()
+		if conf.SignedDownloads {
+			get = signedDownloadURL(fileStorePath)
+		}
+		log.Printf("Web upload: slot for %s (%d bytes) issued to %s", fileStorePath, req.Size, user)
+		writeJSON(w, 200, map[string]string{"put": put.String(), "get": get})
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+/*
+ * Zip archive of everything under a prefix, for data export requests and
+ * room archives. Built while streaming, nothing is buffered on disk.
+ */
+
+import (
+	"archive/zip"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+/*
+ * GET /api/zip?prefix=<user or conversation prefix>
+ */
+func handleZip(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(w, r) {
+		return
+	}
+	prefix := strings.Trim(r.URL.Query().Get("prefix"), "/")
+	if prefix == "" {
+		http.Error(w, "400 Need a prefix", 400)
+		return
+	}
+	// Whole path components only, thomas isn't thomas2
+	prefix += "/"
+
+	name := strings.Trim(strings.ReplaceAll(prefix, "/", "_"), "_") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+
+	// Once we've started writing there's no way to signal an error other than
+	// cutting the archive short, which clients will notice.
+	zw := zip.NewWriter(w)
+	n := 0
+	for entry := range storageList(r.Context(), prefix) {
+		if entry.Err != nil {
+			log.Println("Listing objects for zip failed:", entry.Err)
+			return
+		}
+		if err := addToZip(r, zw, prefix, entry); err != nil {
+			log.Println("Adding", entry.Key, "to zip failed:", err)
+			return
+		}
+		n++
+	}
+	if err := zw.Close(); err != nil {
+		log.Println("Finishing zip failed:", err)
+		return
+	}
+	log.Printf("Sent zip of %d files under %s", n, prefix)
+}
+
+func addToZip(r *http.Request, zw *zip.Writer, prefix string, entry minio.ObjectInfo) error {
+	obj, err := storageGet(r.Context(), entry.Key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	info, err := obj.Stat()
+	if err != nil {
+		return err
+	}
+	body, err := plainReader(obj, info)
+	if err != nil {
+		return err
+	}
+
+	// Keep the last component of the prefix as the top level directory, and
+	// make sure nothing can point outside of it when extracted.
+	name := strings.TrimPrefix(entry.Key, path.Dir(strings.TrimSuffix(prefix, "/"))+"/")
+	hdr := &zip.FileHeader{
+		Name:     strings.TrimPrefix(path.Clean("/"+name), "/"),
+		Method:   zip.Store,
+		Modified: entry.LastModified,
+	}
+	if isCompressible(mime.TypeByExtension(filepath.Ext(entry.Key))) {
+		hdr.Method = zip.Deflate
+	}
+	fw, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, body)
+	return err
+}